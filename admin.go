@@ -0,0 +1,182 @@
+package graceful
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admin is an http.Handler letting operators control a Server. It should
+// be served on a separate listener, such as a localhost or unix socket
+// one, and offers:
+//
+//	POST /drain          pause the server, rejecting new connections
+//	POST /cancel-drain   resume a paused server
+//	POST /stop?timeout=  initiate a graceful shutdown with the given timeout,
+//	                     or the server's Timeout, or set the remaining
+//	                     timeout of a shutdown in progress
+//	GET  /status         report the server's state and connection counts
+//
+// Draining is thus a two-step process, which can be cancelled until it is
+// committed with /stop. Both /drain and /stop give BeforeShutdown a chance
+// to veto the shutdown, unless the server was already paused.
+//
+// Requests must be authorized either by Token or by AllowUIDs; an Admin
+// with neither rejects every request.
+//
+// Example:
+//
+//	admin := &http.Server{
+//		Handler:     &graceful.Admin{Server: srv, AllowUIDs: []int{os.Getuid()}},
+//		ConnContext: graceful.AdminConnContext,
+//	}
+//	l, _ := net.Listen("unix", "/run/myapp/admin.sock")
+//	go admin.Serve(l)
+type Admin struct {
+	// Server is the server to control.
+	Server *Server
+
+	// Token, if set, authorizes requests carrying it in an
+	// "Authorization: Bearer" header.
+	Token string
+
+	// AllowUIDs, if set, authorizes requests made over a unix socket by a
+	// process running as one of these users. The http.Server serving the
+	// Admin must use AdminConnContext as its ConnContext. Peer credentials
+	// are only available on Linux.
+	AllowUIDs []int
+}
+
+// AdminStatus is the response to GET /status.
+type AdminStatus struct {
+	State       string `json:"state"`
+	Connections int    `json:"connections"`
+	Idle        int    `json:"idle"`
+
+	// ReapedIdle and ReapedOverCap are the counts returned by ReapedCounts.
+	ReapedIdle    int `json:"reaped_idle"`
+	ReapedOverCap int `json:"reaped_over_cap"`
+
+	// Cut is the count returned by CutCount.
+	Cut int `json:"cut"`
+}
+
+type peerCredentialsKey struct{}
+
+// peerCredentials identifies the process at the other end of a unix socket.
+type peerCredentials struct {
+	PID, UID, GID int
+}
+
+// AdminConnContext records the credentials of the peer of unix socket
+// connections, so that Admin can check them against AllowUIDs. It is meant
+// to be used as the ConnContext of the http.Server serving an Admin.
+func AdminConnContext(ctx context.Context, c net.Conn) context.Context {
+	cred, ok := peerCredentialsOf(c)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey{}, cred)
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		if a.Token != "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/status":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		open, idle := a.Server.ConnectionCounts()
+		w.Header().Set("Content-Type", "application/json")
+		reapedIdle, reapedOverCap := a.Server.ReapedCounts()
+		json.NewEncoder(w).Encode(AdminStatus{
+			State:         a.Server.State().String(),
+			Connections:   open,
+			Idle:          idle,
+			ReapedIdle:    reapedIdle,
+			ReapedOverCap: reapedOverCap,
+			Cut:           a.Server.CutCount(),
+		})
+	case "/drain":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		a.respond(w, a.Server.Pause())
+	case "/stop":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		timeout := a.Server.Timeout
+		if v := r.URL.Query().Get("timeout"); v != "" {
+			var err error
+			if timeout, err = time.ParseDuration(v); err != nil || timeout < 0 {
+				http.Error(w, "invalid timeout", http.StatusBadRequest)
+				return
+			}
+		}
+		switch a.Server.State() {
+		case StateServing, StatePaused, StateDraining:
+		default:
+			http.Error(w, "server is "+a.Server.State().String(), http.StatusConflict)
+			return
+		}
+		a.Server.Stop(timeout)
+		w.WriteHeader(http.StatusAccepted)
+	case "/cancel-drain":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		a.respond(w, a.Server.Resume())
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// respond reports the outcome of a pause or resume.
+func (a *Admin) respond(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error()+" (server is "+a.Server.State().String()+")", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	if a.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if token := strings.TrimPrefix(auth, "Bearer "); token != auth &&
+			subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1 {
+			return true
+		}
+	}
+	if cred, ok := r.Context().Value(peerCredentialsKey{}).(peerCredentials); ok {
+		for _, uid := range a.AllowUIDs {
+			if cred.UID == uid {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
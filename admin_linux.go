@@ -0,0 +1,26 @@
+package graceful
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCredentialsOf(c net.Conn) (peerCredentials, bool) {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return peerCredentials{}, false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return peerCredentials{}, false
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return peerCredentials{}, false
+	}
+	return peerCredentials{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}, true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package graceful
+
+import "net"
+
+func peerCredentialsOf(c net.Conn) (peerCredentials, bool) {
+	return peerCredentials{}, false
+}
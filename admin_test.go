@@ -0,0 +1,227 @@
+package graceful
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func startAdminTarget(t *testing.T) (*Server, *PipeListener) {
+	l := NewPipeListener()
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})},
+	}
+	go srv.Serve(l)
+	for srv.State() != StateServing {
+		time.Sleep(time.Millisecond)
+	}
+	t.Cleanup(func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	})
+	return srv, l
+}
+
+func adminRequest(admin http.Handler, method, target, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminAuthorization(t *testing.T) {
+	srv, _ := startAdminTarget(t)
+
+	if w := adminRequest(&Admin{Server: srv}, "GET", "/status", ""); w.Code != http.StatusForbidden {
+		t.Fatalf("expected an unconfigured admin to forbid requests, got %d", w.Code)
+	}
+	admin := &Admin{Server: srv, Token: "secret"}
+	if w := adminRequest(admin, "GET", "/status", ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a missing token to be rejected, got %d", w.Code)
+	}
+	if w := adminRequest(admin, "GET", "/status", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong token to be rejected, got %d", w.Code)
+	}
+	if w := adminRequest(admin, "GET", "/status", "secret"); w.Code != http.StatusOK {
+		t.Fatalf("expected the token to be accepted, got %d", w.Code)
+	}
+}
+
+func TestAdminStatusAndDrain(t *testing.T) {
+	srv, l := startAdminTarget(t)
+	admin := &Admin{Server: srv, Token: "secret"}
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(waitTime)
+
+	w := adminRequest(admin, "GET", "/status", "secret")
+	var status AdminStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status != (AdminStatus{State: "serving", Connections: 1, Idle: 1}) {
+		t.Fatalf("unexpected status %+v", status)
+	}
+
+	if w := adminRequest(admin, "GET", "/drain", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected drain to require POST, got %d", w.Code)
+	}
+	if w := adminRequest(admin, "POST", "/cancel-drain", "secret"); w.Code != http.StatusConflict {
+		t.Fatalf("expected cancelling without a drain to conflict, got %d", w.Code)
+	}
+	if w := adminRequest(admin, "POST", "/drain", "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected drain to succeed, got %d", w.Code)
+	}
+	if state := srv.State(); state != StatePaused {
+		t.Fatalf("expected the server to be paused, got %s", state)
+	}
+	if w := adminRequest(admin, "POST", "/cancel-drain", "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected cancel-drain to succeed, got %d", w.Code)
+	}
+	if state := srv.State(); state != StateServing {
+		t.Fatalf("expected the server to be serving again, got %s", state)
+	}
+
+	adminRequest(admin, "POST", "/drain", "secret")
+	conn.Close()
+	if w := adminRequest(admin, "POST", "/stop", "secret"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected stop to be accepted, got %d", w.Code)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to drain")
+	}
+	if w := adminRequest(admin, "POST", "/drain", "secret"); w.Code != http.StatusConflict {
+		t.Fatalf("expected draining a stopped server to conflict, got %d", w.Code)
+	}
+}
+
+func TestAdminStop(t *testing.T) {
+	srv, l := startAdminTarget(t)
+	admin := &Admin{Server: srv, Token: "secret"}
+
+	// An active connection holds the server until it is killed.
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	if w := adminRequest(admin, "POST", "/stop?timeout=soon", "secret"); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected an invalid timeout to be rejected, got %d", w.Code)
+	}
+	if w := adminRequest(admin, "POST", "/stop?timeout=10ms", "secret"); w.Code != http.StatusAccepted {
+		t.Fatalf("expected stop to be accepted, got %d", w.Code)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 1 {
+		t.Fatalf("expected the active connection to be killed, got %+v", report)
+	}
+}
+
+func TestAdminStopWhileDraining(t *testing.T) {
+	srv, l := startAdminTarget(t)
+	admin := &Admin{Server: srv, Token: "secret"}
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	// The request holds the drain for much longer than the test.
+	srv.Stop(time.Minute)
+	for srv.State() != StateDraining {
+		time.Sleep(time.Millisecond)
+	}
+
+	codes := make(chan int, 1)
+	go func() {
+		codes <- adminRequest(admin, "POST", "/stop?timeout=10ms", "secret").Code
+	}()
+	select {
+	case code := <-codes:
+		if code != http.StatusAccepted {
+			t.Fatalf("expected stop to be accepted, got %d", code)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while stopping a draining server")
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the new timeout to kill the request")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 1 {
+		t.Fatalf("expected the active connection to be killed, got %+v", report)
+	}
+}
+
+func TestAdminPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	srv, _ := startAdminTarget(t)
+
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := &Admin{Server: srv, AllowUIDs: []int{os.Getuid()}}
+	hs := &http.Server{Handler: admin, ConnContext: AdminConnContext}
+	go hs.Serve(l)
+	defer hs.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://admin/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the current user to be allowed, got %d", resp.StatusCode)
+	}
+
+	admin.AllowUIDs = []int{os.Getuid() + 1}
+	client.CloseIdleConnections()
+	resp, err = client.Get("http://admin/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected other users to be forbidden, got %d", resp.StatusCode)
+	}
+}
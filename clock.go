@@ -0,0 +1,29 @@
+package graceful
+
+import "time"
+
+// Clock is the source of time used by a Server for its shutdown timers. It
+// may be replaced to test shutdown behavior without sleeping; see the
+// gracefultest package for a fake implementation.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time
+	// on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clock returns the Clock used by the server.
+func (srv *Server) clock() Clock {
+	if srv.Clock == nil {
+		return realClock{}
+	}
+	return srv.Clock
+}
@@ -0,0 +1,67 @@
+package graceful
+
+import "context"
+
+// delaysShutdown reports whether the server keeps serving for a while once
+// shutdown is initiated.
+func (srv *Server) delaysShutdown(r *run) bool {
+	r.registerLock.Lock()
+	registered := r.registered != nil
+	r.registerLock.Unlock()
+
+	return registered || srv.ShutdownDelay > 0 || srv.ShutdownDelayFunc != nil
+}
+
+// delayShutdown keeps the server serving while it is deregistered,
+// ShutdownDelayFunc runs and ShutdownDelay elapses. The returned channel is closed once the delay is
+// over, and the returned function cuts it short.
+func (srv *Server) delayShutdown(r *run) (<-chan struct{}, context.CancelFunc) {
+	clock := srv.clock()
+	start := clock.Now()
+	r.delayLock.Lock()
+	r.delayStarted = start
+	r.delayLock.Unlock()
+	srv.shutdownSpan(r).AddEvent("stage", Attr("graceful.stage", StageDelay.String()))
+	srv.notifyStage(StageDelay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if budget := srv.ShutdownBudget; budget > 0 {
+		budgetSpent := clock.After(budget)
+		go func() {
+			select {
+			case <-budgetSpent:
+				srv.log(LevelWarn, "shutdown budget spent, ending the delay", "budget", budget)
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		srv.deregister(ctx, r)
+		if srv.ShutdownDelayFunc != nil && ctx.Err() == nil {
+			srv.log(LevelInfo, "waiting for ShutdownDelayFunc")
+			if err := srv.ShutdownDelayFunc(ctx); err != nil {
+				srv.log(LevelError, "ShutdownDelayFunc failed", "error", err)
+			}
+		}
+		if d := srv.ShutdownDelay; d > 0 && ctx.Err() == nil {
+			srv.log(LevelInfo, "delaying shutdown", "delay", d)
+			select {
+			case <-clock.After(d):
+			case <-ctx.Done():
+			}
+		}
+
+		delay := clock.Now().Sub(start)
+		r.delayLock.Lock()
+		r.delay = delay
+		r.delayLock.Unlock()
+		srv.log(LevelInfo, "shutdown delay over", "delay", delay)
+	}()
+	return done, cancel
+}
@@ -0,0 +1,63 @@
+package graceful
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DrainPolicy rejects the requests which begin once the server is draining,
+// such as on keep-alive or HTTP/2 connections which are still open, so that
+// clients and proxies retry them elsewhere. Requests already in flight are
+// not affected.
+type DrainPolicy struct {
+	// RetryAfter is advertised in the Retry-After header, rounded up to the
+	// second. If zero, clients are told to retry after 1 second.
+	RetryAfter time.Duration
+
+	// Handler optionally writes the response to rejected requests. The
+	// Retry-After and Connection headers are set before it is called. If
+	// nil, a 503 Service Unavailable response is written.
+	Handler http.Handler
+}
+
+func (p *DrainPolicy) reject(rw http.ResponseWriter, r *http.Request) {
+	seconds := (p.RetryAfter + time.Second - 1) / time.Second
+	if seconds <= 0 {
+		seconds = 1
+	}
+	rw.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	rw.Header().Set("Connection", "close")
+	if p.Handler != nil {
+		p.Handler.ServeHTTP(rw, r)
+		return
+	}
+	http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// drainHandler applies the DrainPolicy, Routes and connection recycling of
+// a server in front of the handler of its http.Server.
+type drainHandler struct {
+	srv     *Server
+	handler http.Handler
+}
+
+func (h drainHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	route := h.srv.route(r)
+	if p := h.srv.DrainPolicy; p != nil && !route.AlwaysServe {
+		switch h.srv.State() {
+		case StateDraining, StateKilling:
+			h.srv.log(LevelDebug, "request rejected", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			p.reject(rw, r)
+			return
+		}
+	}
+	if h.srv.recycling(r) {
+		rw.Header().Set("Connection", "close")
+	}
+	handler := h.handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	h.srv.serveRoute(route, handler, rw, r)
+}
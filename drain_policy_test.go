@@ -0,0 +1,81 @@
+package graceful
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainPolicy(t *testing.T) {
+	pl := NewPipeListener()
+	release := make(chan struct{})
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		DrainPolicy:      &DrainPolicy{RetryAfter: 1500 * time.Millisecond},
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-release
+		})},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	srv.Stop(timeoutTime)
+	for srv.State() != StateDraining {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A request beginning now, such as on an HTTP/2 connection, is rejected.
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if h := rec.Header(); h.Get("Retry-After") != "2" || h.Get("Connection") != "close" {
+		t.Errorf("unexpected headers %v", h)
+	}
+
+	// The request in flight completes.
+	close(release)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected the request in flight to complete with status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+	<-srv.StopChan()
+}
+
+func TestDrainPolicyHandler(t *testing.T) {
+	srv := &Server{
+		DrainPolicy: &DrainPolicy{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusTeapot)
+		})},
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})},
+	}
+	srv.installHooks()
+
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected requests to be served before the drain, got status %d", rec.Code)
+	}
+
+	srv.transition(StateDraining)
+	rec = httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusTeapot || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected the custom handler to reject the request, got status %d and headers %v", rec.Code, rec.Header())
+	}
+}
@@ -0,0 +1,138 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Drainable is a server that can shut itself down, such as a gRPC server.
+type Drainable interface {
+	// Serve accepts connections on l until the server is stopped.
+	Serve(l net.Listener) error
+
+	// GracefulStop stops accepting connections and blocks until every
+	// pending request has finished.
+	GracefulStop()
+
+	// Stop closes all connections and cancels pending requests.
+	Stop()
+}
+
+// Runner runs a Drainable server with the same signal handling, shutdown
+// callbacks and timeout as Server.
+//
+// When shutdown is initiated, the Drainable's GracefulStop is called. If it
+// has not returned once Timeout elapses, Stop is called. In the
+// ShutdownReport, the Drainable counts as a single connection, which is
+// killed if Stop had to be called.
+//
+// Example:
+//
+//	r := &graceful.Runner{
+//		Server:    grpcServer,
+//		Lifecycle: graceful.Lifecycle{Timeout: 10 * time.Second},
+//	}
+//	r.ListenAndServe(":50051")
+type Runner struct {
+	// Server is the server to run.
+	Server Drainable
+
+	// Limit the number of open connections
+	ListenLimit int
+
+	// TCPKeepAlive sets the TCP keep-alive timeouts on accepted
+	// connections, if the listener is created by ListenAndServe.
+	TCPKeepAlive time.Duration
+
+	// Lifecycle's Timeout is the duration to allow GracefulStop to finish
+	// before calling Stop.
+	Lifecycle
+}
+
+// ListenAndServe listens on the TCP address addr and runs the server on
+// it.
+func (r *Runner) ListenAndServe(addr string) error {
+	srv := r.server()
+	srv.TCPKeepAlive = r.TCPKeepAlive
+	l, err := srv.newTCPListener(addr)
+	if err != nil {
+		return srv.startFailed(err)
+	}
+	return r.Serve(l)
+}
+
+// Serve runs the server on listener with graceful shutdown enabled.
+func (r *Runner) Serve(listener net.Listener) error {
+	if r.Server == nil {
+		return errors.New("graceful: Runner has no Server")
+	}
+	srv, err := r.configure(func(srv *Server) engine {
+		return &drainEngine{srv: srv, runner: r}
+	})
+	if err != nil {
+		return err
+	}
+	srv.ListenLimit = r.ListenLimit
+
+	// Both GracefulStop and graceful close the listener.
+	return srv.Serve(&onceCloseListener{Listener: listener})
+}
+
+// drainEngine serves with a Drainable, which graceful tracks as a single
+// connection: it is active until GracefulStop returns, and closing it
+// calls Stop.
+type drainEngine struct {
+	srv    *Server
+	runner *Runner
+
+	// conn stands for the Drainable during the current run.
+	conn *serverConn
+}
+
+func (e *drainEngine) hook() {
+	e.conn = &serverConn{stop: e.runner.Server.Stop}
+}
+
+func (e *drainEngine) setDraining(draining bool) {
+	if !draining {
+		return
+	}
+	conn := e.conn
+	if conn.draining.Swap(true) {
+		return
+	}
+	go func() {
+		e.runner.Server.GracefulStop()
+		conn.release(e.srv)
+	}()
+}
+
+func (e *drainEngine) serve(l net.Listener) error {
+	conn := e.conn
+	conn.addr = l.Addr()
+	e.srv.connState(conn, http.StateNew)
+	e.srv.connState(conn, http.StateActive)
+
+	err := e.runner.Server.Serve(l)
+	if !conn.draining.Load() {
+		// the server stopped on its own, so there is nothing to wait for.
+		conn.release(e.srv)
+	}
+	return err
+}
+
+// onceCloseListener makes Close idempotent, so that the listener may be
+// closed by both graceful and the server it was handed to.
+type onceCloseListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *onceCloseListener) Close() error {
+	l.once.Do(func() { l.err = l.Listener.Close() })
+	return l.err
+}
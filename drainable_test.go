@@ -0,0 +1,184 @@
+package graceful
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+// fakeDrainable holds each accepted connection open until the client
+// closes it, like a server with one long request per connection.
+type fakeDrainable struct {
+	mu       sync.Mutex
+	l        net.Listener
+	conns    map[net.Conn]struct{}
+	wg       sync.WaitGroup
+	graceful bool
+	stopped  bool
+}
+
+func (d *fakeDrainable) Serve(l net.Listener) error {
+	d.mu.Lock()
+	d.l = l
+	d.conns = map[net.Conn]struct{}{}
+	d.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if d.graceful || d.stopped {
+				return nil
+			}
+			return err
+		}
+		d.mu.Lock()
+		d.conns[conn] = struct{}{}
+		d.wg.Add(1)
+		d.mu.Unlock()
+		go func() {
+			defer d.wg.Done()
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}()
+	}
+}
+
+func (d *fakeDrainable) GracefulStop() {
+	d.mu.Lock()
+	d.graceful = true
+	d.l.Close()
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *fakeDrainable) Stop() {
+	d.mu.Lock()
+	d.stopped = true
+	d.l.Close()
+	for conn := range d.conns {
+		conn.Close()
+	}
+	d.mu.Unlock()
+	d.wg.Wait()
+}
+
+func (d *fakeDrainable) calls() (graceful, stopped bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.graceful, d.stopped
+}
+
+func TestRunnerGracefulStop(t *testing.T) {
+	l := NewPipeListener()
+	d := &fakeDrainable{}
+	initiated := make(chan struct{})
+	r := &Runner{
+		Server: d,
+		Lifecycle: Lifecycle{
+			Timeout:           timeoutTime,
+			NoSignalHandling:  true,
+			ShutdownInitiated: func() { close(initiated) },
+		},
+	}
+	served := make(chan error, 1)
+	go func() { served <- r.Serve(l) }()
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(waitTime)
+
+	r.Stop(timeoutTime)
+	<-initiated
+	select {
+	case <-r.StopChan():
+		t.Fatal("runner stopped while a connection was open")
+	case <-time.After(waitTime):
+	}
+	if graceful, _ := d.calls(); !graceful {
+		t.Fatal("expected GracefulStop to be called")
+	}
+
+	conn.Close()
+	select {
+	case <-r.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the runner to stop")
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("Serve returned %s", err)
+	}
+	if _, stopped := d.calls(); stopped {
+		t.Fatal("expected Stop not to be called")
+	}
+	if report := r.ShutdownReport(); report.Killed != 0 {
+		t.Fatalf("unexpected shutdown report %+v", report)
+	}
+}
+
+func TestRunnerStopsAtTimeout(t *testing.T) {
+	l := NewPipeListener()
+	d := &fakeDrainable{}
+	clock := fakeclock.New(time.Now())
+	r := &Runner{
+		Server:    d,
+		Lifecycle: Lifecycle{Timeout: time.Minute, Clock: clock, NoSignalHandling: true},
+	}
+	go r.Serve(l)
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(waitTime)
+
+	r.Stop(time.Minute)
+	clock.BlockUntil(1)
+	select {
+	case <-r.StopChan():
+		t.Fatal("runner stopped before its timeout")
+	default:
+	}
+	clock.Advance(time.Minute)
+	select {
+	case <-r.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the runner to stop")
+	}
+	if _, stopped := d.calls(); !stopped {
+		t.Fatal("expected Stop to be called")
+	}
+	if report := r.ShutdownReport(); report.Killed != 1 {
+		t.Fatalf("expected the server to be killed, got %+v", report)
+	}
+}
+
+func TestRunnerServeError(t *testing.T) {
+	l := NewPipeListener()
+	l.Close()
+	r := &Runner{
+		Server:    &fakeDrainable{},
+		Lifecycle: Lifecycle{Timeout: timeoutTime, NoSignalHandling: true},
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- r.Serve(l) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected the error of the server's Serve")
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for Serve to return")
+	}
+	if state := r.State(); state != StateStopped {
+		t.Fatalf("expected the runner to be stopped, got %s", state)
+	}
+}
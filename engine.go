@@ -0,0 +1,76 @@
+package graceful
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// engine serves the connections accepted by a Server. The http.Server is
+// the default engine; StreamServer plugs in its own.
+type engine interface {
+	// serve accepts connections on l until it is closed.
+	serve(l net.Listener) error
+
+	// hook points the engine's connection state changes and contexts at
+	// the current run of the Server. It is called at the start of each run.
+	hook()
+
+	// setDraining tells the engine whether it should wind connections down
+	// rather than reuse them.
+	setDraining(draining bool)
+}
+
+// httpEngine serves connections with the Server's http.Server.
+type httpEngine struct {
+	srv *Server
+}
+
+func (e httpEngine) serve(l net.Listener) error { return e.srv.Server.Serve(l) }
+func (e httpEngine) hook()                      { e.srv.installHooks() }
+func (e httpEngine) setDraining(draining bool)  { e.srv.SetKeepAlivesEnabled(!draining) }
+
+// backend returns the engine serving connections for the server.
+func (srv *Server) backend() engine {
+	if srv.engine == nil {
+		return httpEngine{srv}
+	}
+	return srv.engine
+}
+
+// serverConn stands for a whole server within graceful's connection
+// tracking, for engines which do not hand it individual connections. It is
+// active until released, and closing it stops the server.
+type serverConn struct {
+	addr net.Addr
+	stop func()
+
+	// draining is set once the server has been asked to drain.
+	draining    atomic.Bool
+	releaseOnce sync.Once
+	stopOnce    sync.Once
+}
+
+// release reports the connection as closed.
+func (c *serverConn) release(srv *Server) {
+	c.releaseOnce.Do(func() { srv.connState(c, http.StateClosed) })
+}
+
+// Close forcefully stops the server.
+func (c *serverConn) Close() error {
+	c.stopOnce.Do(c.stop)
+	return nil
+}
+
+var errServerConn = errors.New("graceful: not a connection")
+
+func (c *serverConn) Read(b []byte) (int, error)         { return 0, errServerConn }
+func (c *serverConn) Write(b []byte) (int, error)        { return 0, errServerConn }
+func (c *serverConn) LocalAddr() net.Addr                { return c.addr }
+func (c *serverConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *serverConn) SetDeadline(t time.Time) error      { return nil }
+func (c *serverConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *serverConn) SetWriteDeadline(t time.Time) error { return nil }
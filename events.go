@@ -0,0 +1,149 @@
+package graceful
+
+import (
+	"os"
+	"time"
+)
+
+// EventKind identifies a lifecycle event of a Server.
+type EventKind int
+
+const (
+	// EventSignal is emitted when the server receives a signal, including
+	// the ones simulated by Stop, Drain and Signal.
+	EventSignal EventKind = iota
+
+	// EventDrainStarted is emitted once a shutdown has been allowed to
+	// proceed. Count is the number of open connections.
+	EventDrainStarted
+
+	// EventListenerClosed is emitted once the server stops accepting
+	// connections.
+	EventListenerClosed
+
+	// EventIdleClosed is emitted when idle connections are closed during
+	// shutdown. Count is the number of connections closed.
+	EventIdleClosed
+
+	// EventStage is emitted each time the shutdown reaches a new Stage.
+	EventStage
+
+	// EventTimeout is emitted when the shutdown timeout elapses before
+	// every connection has finished.
+	EventTimeout
+
+	// EventKilled is emitted when the remaining connections are forcefully
+	// closed. Count is the number of connections closed.
+	EventKilled
+
+	// EventStopped is emitted once the server has stopped. Count is the
+	// number of connections which were open when the shutdown began.
+	EventStopped
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventSignal:
+		return "signal"
+	case EventDrainStarted:
+		return "drain started"
+	case EventListenerClosed:
+		return "listener closed"
+	case EventIdleClosed:
+		return "idle closed"
+	case EventStage:
+		return "stage"
+	case EventTimeout:
+		return "timeout"
+	case EventKilled:
+		return "killed"
+	case EventStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// Event describes a lifecycle event of a Server.
+type Event struct {
+	Kind EventKind
+
+	// Time is when the event happened, as given by the server's Clock.
+	Time time.Time
+
+	// Signal is the signal received, for EventSignal. Stop and Drain send
+	// a signal of their own, named "stop".
+	Signal os.Signal
+
+	// Stage is the stage reached, for EventStage.
+	Stage ShutdownStage
+
+	// Count is the number of connections concerned by the event, as
+	// documented for each EventKind.
+	Count int
+
+	// Dropped is the number of events which were not delivered to this
+	// channel before this one, because it was full.
+	Dropped int
+}
+
+// eventSubscriber is a channel returned by Events.
+type eventSubscriber struct {
+	ch      chan Event
+	dropped int
+}
+
+// Events returns a channel on which the lifecycle events of the server are
+// delivered, and a function which stops the delivery and closes the
+// channel. Events are never waited for: if the channel, which holds up to
+// buffer events, is full, they are dropped, and the number of dropped
+// events is reported by the next delivered one.
+func (srv *Server) Events(buffer int) (events <-chan Event, unsubscribe func()) {
+	srv.eventLock.Lock()
+	defer srv.eventLock.Unlock()
+
+	if srv.eventSubscribers == nil {
+		srv.eventSubscribers = map[int]*eventSubscriber{}
+	}
+	id := srv.nextEventSubscriber
+	srv.nextEventSubscriber++
+	sub := &eventSubscriber{ch: make(chan Event, buffer)}
+	srv.eventSubscribers[id] = sub
+
+	return sub.ch, func() {
+		srv.eventLock.Lock()
+		defer srv.eventLock.Unlock()
+
+		if _, ok := srv.eventSubscribers[id]; ok {
+			delete(srv.eventSubscribers, id)
+			close(sub.ch)
+		}
+	}
+}
+
+// emit delivers e to the subscribers without blocking.
+func (srv *Server) emit(e Event) {
+	srv.eventLock.Lock()
+	defer srv.eventLock.Unlock()
+
+	if len(srv.eventSubscribers) == 0 {
+		return
+	}
+	e.Time = srv.clock().Now()
+	for _, sub := range srv.eventSubscribers {
+		e.Dropped = sub.dropped
+		select {
+		case sub.ch <- e:
+			sub.dropped = 0
+		default:
+			sub.dropped++
+		}
+	}
+}
+
+// notifyStage reports that the shutdown reached stage.
+func (srv *Server) notifyStage(stage ShutdownStage) {
+	if srv.StageReached != nil {
+		srv.StageReached(stage)
+	}
+	srv.emit(Event{Kind: EventStage, Stage: stage})
+}
@@ -0,0 +1,108 @@
+package graceful
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+func TestEvents(t *testing.T) {
+	pl := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Timeout:          time.Minute,
+		Clock:            clock,
+		NoSignalHandling: true,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})},
+	}
+	events, unsubscribe := srv.Events(100)
+	defer unsubscribe()
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	// One connection stays idle, and a request holds the other one active
+	// until it is killed.
+	idle, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	active, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	go active.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	srv.Stop(time.Minute)
+	// the idle connection is closed right away, and only the active one is
+	// left to kill.
+	awaitOpen(t, srv, 1)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	byKind := map[EventKind]Event{}
+	var order []EventKind
+	timeout := time.After(timeoutTime * 2)
+	for byKind[EventStopped].Kind != EventStopped {
+		select {
+		case e := <-events:
+			if e.Time.IsZero() {
+				t.Errorf("expected %s event to have a time", e.Kind)
+			}
+			if _, ok := byKind[e.Kind]; !ok {
+				byKind[e.Kind] = e
+				order = append(order, e.Kind)
+			}
+		case <-timeout:
+			t.Fatalf("Timed out while waiting for the stopped event, got %v", order)
+		}
+	}
+
+	if e := byKind[EventSignal]; e.Signal != (stopSignal{}) {
+		t.Errorf("expected a stop signal event, got %v", e.Signal)
+	}
+	if e := byKind[EventDrainStarted]; e.Count != 2 {
+		t.Errorf("expected 2 open connections when the drain started, got %d", e.Count)
+	}
+	if e := byKind[EventIdleClosed]; e.Count != 1 {
+		t.Errorf("expected 1 idle connection to be closed, got %d", e.Count)
+	}
+	if e := byKind[EventKilled]; e.Count != 1 {
+		t.Errorf("expected 1 connection to be killed, got %d", e.Count)
+	}
+	for _, kind := range []EventKind{EventListenerClosed, EventStage, EventTimeout} {
+		if _, ok := byKind[kind]; !ok {
+			t.Errorf("expected a %s event, got %v", kind, order)
+		}
+	}
+	if order[0] != EventSignal || order[1] != EventDrainStarted || order[len(order)-1] != EventStopped {
+		t.Errorf("unexpected order of events %v", order)
+	}
+}
+
+func TestEventsAreNotWaitedFor(t *testing.T) {
+	srv := &Server{}
+	events, unsubscribe := srv.Events(1)
+
+	srv.emit(Event{Kind: EventSignal})
+	srv.emit(Event{Kind: EventDrainStarted})
+	srv.emit(Event{Kind: EventListenerClosed})
+	if e := <-events; e.Kind != EventSignal || e.Dropped != 0 {
+		t.Fatalf("expected the first event to be delivered, got %+v", e)
+	}
+	srv.emit(Event{Kind: EventStopped})
+	if e := <-events; e.Kind != EventStopped || e.Dropped != 2 {
+		t.Fatalf("expected the dropped events to be counted, got %+v", e)
+	}
+
+	unsubscribe()
+	srv.emit(Event{Kind: EventStopped})
+	if _, ok := <-events; ok {
+		t.Fatal("expected the channel to be closed once unsubscribed")
+	}
+}
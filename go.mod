@@ -0,0 +1,10 @@
+module gopkg.in/tylerb/graceful.v1
+
+go 1.21
+
+require (
+	github.com/urfave/negroni v1.0.0
+	golang.org/x/net v0.21.0
+)
+
+require golang.org/x/text v0.14.0 // indirect
@@ -1,12 +1,14 @@
 package graceful
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,6 +43,112 @@ type Server struct {
 	// must not be set directly.
 	ConnState func(net.Conn, http.ConnState)
 
+	// Clock is the source of time for the shutdown timers. If nil, the
+	// system clock is used.
+	Clock Clock
+
+	// BaseContext optionally specifies a function that returns the base
+	// context for incoming requests on a listener. If nil, the underlying
+	// http.Server's BaseContext is used. Either way, graceful derives request
+	// contexts from it so they can be cancelled during shutdown.
+	BaseContext func(net.Listener) context.Context
+
+	// ShutdownPolicy optionally escalates the shutdown through several
+	// stages before the connections are killed. If nil, connections are
+	// killed once Timeout has elapsed.
+	ShutdownPolicy *ShutdownPolicy
+
+	// OnListen is an optional callback function that is called with the
+	// addresses the server listens on, once they are bound and the server
+	// starts serving. It is useful with ":0" addresses.
+	OnListen func(addrs []net.Addr)
+
+	// StageReached is an optional callback function that is called each time
+	// the shutdown reaches a new stage.
+	StageReached func(ShutdownStage)
+
+	// ShutdownDelay is the duration to keep serving once shutdown is
+	// initiated, before the listener is closed, so that load balancers
+	// have time to stop sending traffic to the server.
+	ShutdownDelay time.Duration
+
+	// ShutdownDelayFunc is an optional function that is called once
+	// shutdown is initiated, before ShutdownDelay, such as to deregister
+	// the server from service discovery. The server keeps serving until it
+	// returns. ctx is cancelled if the delay is cut short.
+	ShutdownDelayFunc func(ctx context.Context) error
+
+	// Registrar optionally registers the server with service discovery
+	// once its listener is bound, and deregisters it once shutdown is
+	// initiated, before ShutdownDelayFunc and ShutdownDelay. Serve fails if
+	// the server cannot be registered.
+	Registrar Registrar
+
+	// RegisterAttempts is the number of times registration and
+	// deregistration are attempted before giving up. If zero, 3 attempts
+	// are made.
+	RegisterAttempts int
+
+	// RegisterTimeout bounds each registration and deregistration attempt.
+	// If zero, attempts time out after 5 seconds.
+	RegisterTimeout time.Duration
+
+	// ShutdownBudget optionally bounds the whole shutdown, from the moment
+	// it is initiated. The delay is cut short once the budget is spent, and
+	// the remaining connections are killed once it is exhausted, even if
+	// Timeout or the ShutdownPolicy allow for more.
+	ShutdownBudget time.Duration
+
+	// WaitForRequests makes the shutdown complete once every request
+	// handed to the underlying http.Server's Handler has finished, closing
+	// the idle and HTTP/2 connections left open, rather than once every
+	// connection has closed. It is meant for HTTP/2, where a connection
+	// stays active between its streams. The requests are listed by
+	// InFlight. It must be set before Serve is first called, as requests
+	// are counted in front of the Handler.
+	WaitForRequests bool
+
+	// DrainPolicy optionally rejects the requests which begin once the
+	// server is draining. It must be set before Serve is first called, as
+	// it is installed in front of the underlying http.Server's Handler.
+	DrainPolicy *DrainPolicy
+
+	// Routes optionally gives the requests matching some http.ServeMux
+	// patterns their own drain behavior. Like DrainPolicy, it must be set
+	// before Serve is first called.
+	Routes map[string]RouteDrain
+
+	// MaxConnectionAge optionally recycles connections once they are
+	// older than this, plus a random duration of up to
+	// MaxConnectionAgeJitter, so that clients spread over new backends.
+	MaxConnectionAge       time.Duration
+	MaxConnectionAgeJitter time.Duration
+
+	// MaxRequestsPerConnection optionally recycles connections once they
+	// have served this many requests.
+	//
+	// Recycled connections are closed once idle, as during shutdown, and
+	// requests they still carry are answered with "Connection: close",
+	// which net/http turns into a GOAWAY for HTTP/2. With HTTP/2, requests
+	// are counted each time the connection becomes active.
+	MaxRequestsPerConnection int
+
+	// ReapIdleAfter optionally closes keep-alive connections which have been
+	// idle for this long while the server is serving. Unlike the
+	// http.Server's IdleTimeout, reaped connections are counted by
+	// ReapedCounts.
+	ReapIdleAfter time.Duration
+
+	// MaxIdleConnections optionally caps the number of idle keep-alive
+	// connections, closing those which have been idle the longest first.
+	MaxIdleConnections int
+
+	// FirstRequestTimeout optionally closes connections which have not
+	// completed their first request headers, or TLS handshake, within this
+	// duration, so that clients sending nothing cannot hold on to the
+	// ListenLimit. Cut connections are counted by CutCount.
+	FirstRequestTimeout time.Duration
+
 	// BeforeShutdown is an optional callback function that is called
 	// before the listener is closed. Returns true if shutdown is allowed
 	BeforeShutdown func() bool
@@ -55,6 +163,23 @@ type Server struct {
 	// manually with Stop().
 	NoSignalHandling bool
 
+	// Signals maps the OS signals graceful listens for to the action taken
+	// when they are received. If nil, SIGINT and SIGTERM drain the server.
+	Signals map[os.Signal]SignalAction
+
+	// Reload is an optional callback function that is called when a signal
+	// mapped to SignalReload is received.
+	Reload func()
+
+	// SignalFunc is an optional callback function that is called when a
+	// signal mapped to SignalCustom is received.
+	SignalFunc func(os.Signal)
+
+	// IgnoreRepeatedSignals prevents a second drain signal received while
+	// the server is already shutting down from forcing the shutdown. If set
+	// to true, repeated signals are only logged.
+	IgnoreRepeatedSignals bool
+
 	// Logger used to notify of errors on startup and on stop.
 	Logger *log.Logger
 
@@ -62,9 +187,14 @@ type Server struct {
 	// you to use whatever logging approach you would like
 	LogFunc func(format string, args ...interface{})
 
-	// Interrupted is true if the server is handling a SIGINT or SIGTERM
-	// signal and is thus shutting down.
-	Interrupted bool
+	// StructuredLogger receives leveled log events with key/value fields.
+	// It takes precedence over Logger and LogFunc, which only receive
+	// events at LevelInfo and above.
+	StructuredLogger StructuredLogger
+
+	// Tracer optionally records a span for the lifetime of each
+	// connection, and one for each shutdown.
+	Tracer Tracer
 
 	// interrupt signals the listener to stop serving connections,
 	// and the server to shut down.
@@ -73,20 +203,122 @@ type Server struct {
 	// stopLock is used to protect against concurrent calls to Stop
 	stopLock sync.Mutex
 
+	// connStateLock serializes calls to ConnState.
+	connStateLock sync.Mutex
+
 	// stopChan is the channel on which callers may block while waiting for
 	// the server to stop.
 	stopChan chan struct{}
 
+	// readyChan is closed once the server is serving, and failedChan if it
+	// fails to start with startErr.
+	readyChan  chan struct{}
+	failedChan chan struct{}
+	startErr   error
+
+	// stopTimeout overrides Timeout once Stop has been called.
+	stopTimeout *time.Duration
+
 	// chanLock is used to protect access to the various channel constructors.
 	chanLock sync.RWMutex
 
+	// state is the current State of the server, accessed atomically.
+	state int32
+
+	// stateLock serializes state transitions and protects subscribers.
+	stateLock sync.Mutex
+
+	// subscribers are notified of state transitions.
+	subscribers    map[int]func(Transition)
+	nextSubscriber int
+
+	// keepAlivesDisabled is true if graceful disabled keep-alives while
+	// shutting down, and must enable them again on the next run.
+	keepAlivesDisabled bool
+
+	// engine serves accepted connections. If nil, the http.Server is used.
+	engine engine
+
+	// run holds the state of the current call to Serve.
+	run atomic.Value
+
+	// requests holds the requests handled with TrackRequests, or every
+	// request handed to the Handler, when WaitForRequests is set.
+	requests requestTracker
+
+	// routes matches requests against Routes, and grace holds those in
+	// flight with an extended grace.
+	routes *http.ServeMux
+	grace  graceTracker
+
+	// streams is the number of registered streams.
+	streams atomic.Int64
+
+	// hooked is the http.Server whose ConnState and BaseContext have been
+	// pointed at graceful, and hookedBaseContext and hookedConnContext its
+	// original BaseContext and ConnContext, if graceful replaced them.
+	hooked            *http.Server
+	hookedBaseContext func(net.Listener) context.Context
+	hookedConnContext func(context.Context, net.Conn) context.Context
+
+	// eventLock protects eventSubscribers, which receive lifecycle events.
+	eventLock           sync.Mutex
+	eventSubscribers    map[int]*eventSubscriber
+	nextEventSubscriber int
+
+	// report is the report of the last completed shutdown.
+	report ShutdownReport
+
 	// connections holds all connections managed by graceful
 	connections map[net.Conn]struct{}
 
 	// idleConnections holds all idle connections managed by graceful
 	idleConnections map[net.Conn]struct{}
+
+	// connInfo holds the age and request count of the connections managed
+	// by graceful.
+	connInfo map[net.Conn]*connInfo
+
+	// keptAlive holds the idle connections which have served a request, when
+	// they are reaped, oldest first.
+	keptAlive *idleQueue
+
+	// reapedIdle and reapedOverCap count the connections reaped because of
+	// ReapIdleAfter and MaxIdleConnections.
+	reapedIdle, reapedOverCap atomic.Int64
+
+	// newConnections holds the connections which have not sent a request
+	// yet, when FirstRequestTimeout is set. Unlike keptAlive ones, they are
+	// idle to graceful but not to their clients.
+	newConnections map[net.Conn]struct{}
+
+	// cut counts the connections closed because of FirstRequestTimeout.
+	cut atomic.Int64
 }
 
+// SignalAction describes how the server reacts to a received signal.
+type SignalAction int
+
+const (
+	// SignalDrain gracefully shuts the server down, allowing outstanding
+	// requests up to Timeout to complete. Receiving a drain signal while
+	// already shutting down forces the shutdown, unless
+	// IgnoreRepeatedSignals is set.
+	SignalDrain SignalAction = iota
+
+	// SignalKill stops the server immediately, closing all connections.
+	SignalKill
+
+	// SignalReload calls the Reload callback.
+	SignalReload
+
+	// SignalCustom calls the SignalFunc callback with the received signal.
+	SignalCustom
+
+	// SignalIgnore discards the signal.
+	SignalIgnore
+)
+
 // Run serves the http.Handler with graceful shutdown enabled.
 //
 // timeout is the duration to wait until killing active requests and stopping the server.
@@ -101,7 +333,7 @@ func Run(addr string, timeout time.Duration, n http.Handler) {
 
 	if err := srv.ListenAndServe(); err != nil {
 		if opErr, ok := err.(*net.OpError); !ok || (ok && opErr.Op != "accept") {
-			srv.logf("%s", err)
+			srv.log(LevelError, "serve failed", "error", err)
 			os.Exit(1)
 		}
 	}
@@ -141,7 +373,7 @@ func (srv *Server) ListenAndServe() error {
 	}
 	conn, err := srv.newTCPListener(addr)
 	if err != nil {
-		return err
+		return srv.startFailed(err)
 	}
 
 	return srv.Serve(conn)
@@ -168,7 +400,7 @@ func (srv *Server) ListenTLS(certFile, keyFile string) (net.Listener, error) {
 
 	config := &tls.Config{}
 	if srv.TLSConfig != nil {
-		*config = *srv.TLSConfig
+		config = srv.TLSConfig.Clone()
 	}
 
 	var err error
@@ -220,7 +452,7 @@ func TLSConfigHasHTTP2Enabled(t *tls.Config) bool {
 func (srv *Server) ListenAndServeTLS(certFile, keyFile string) error {
 	l, err := srv.ListenTLS(certFile, keyFile)
 	if err != nil {
-		return err
+		return srv.startFailed(err)
 	}
 
 	return srv.Serve(l)
@@ -236,7 +468,7 @@ func (srv *Server) ListenAndServeTLSConfig(config *tls.Config) error {
 
 	conn, err := srv.newTCPListener(addr)
 	if err != nil {
-		return err
+		return srv.startFailed(err)
 	}
 
 	srv.TLSConfig = config
@@ -261,82 +493,140 @@ func (srv *Server) Serve(listener net.Listener) error {
 	if srv.ListenLimit != 0 {
 		listener = LimitListener(listener, srv.ListenLimit)
 	}
+	listener = &pauseListener{Listener: listener, srv: srv}
 
 	// Make our stopchan
-	srv.StopChan()
-
-	// Track connection state
-	add := make(chan net.Conn)
-	idle := make(chan net.Conn)
-	active := make(chan net.Conn)
-	remove := make(chan net.Conn)
-
-	srv.Server.ConnState = func(conn net.Conn, state http.ConnState) {
-		switch state {
-		case http.StateNew:
-			add <- conn
-		case http.StateActive:
-			active <- conn
-		case http.StateIdle:
-			idle <- conn
-		case http.StateClosed, http.StateHijacked:
-			remove <- conn
-		}
-
-		srv.stopLock.Lock()
-		defer srv.stopLock.Unlock()
-
-		if srv.ConnState != nil {
-			srv.ConnState(conn, state)
-		}
+	if err := srv.start(); err != nil {
+		return err
 	}
 
+	// Track connection state, and derive request contexts from one we can
+	// cancel during shutdown.
+	r := srv.newRun()
+	defer r.cancel()
+	srv.run.Store(r)
+	srv.backend().hook()
+
 	// Manage open connections
-	shutdown := make(chan chan struct{})
-	kill := make(chan struct{})
-	go srv.manageConnections(add, idle, active, remove, shutdown, kill)
+	go func() {
+		defer close(r.managed)
+		srv.manageConnections(r)
+	}()
 
 	interrupt := srv.interruptChan()
 	// Set up the interrupt handler
 	if !srv.NoSignalHandling {
-		signalNotify(interrupt)
+		signalNotify(interrupt, srv.signals()...)
 	}
 	quitting := make(chan struct{})
-	go srv.handleInterrupt(interrupt, quitting, listener)
-
-	// Serve with graceful listener.
+	finished := make(chan struct{})
+	interruptDone := make(chan struct{})
+	go func() {
+		defer close(interruptDone)
+		srv.handleInterrupt(interrupt, quitting, finished, listener, r)
+	}()
+
+	// Serve with graceful listener, once registered.
 	// Execution blocks here until listener.Close() is called, above.
-	err := srv.Server.Serve(listener)
+	err := srv.register(r, listener.Addr())
 	if err != nil {
-		// If the underlying listening is closed, Serve returns an error
-		// complaining about listening on a closed socket. This is expected, so
-		// let's ignore the error if we are the ones who explicitly closed the
-		// socket.
-		select {
-		case <-quitting:
-			err = nil
-		default:
+		srv.log(LevelError, "register failed", "addr", listener.Addr(), "error", err)
+		srv.startFailed(err)
+		listener.Close()
+	} else {
+		srv.listening(r, listener.Addr())
+		if err = srv.backend().serve(listener); err != nil {
+			// If the underlying listening is closed, Serve returns an error
+			// complaining about listening on a closed socket. This is expected, so
+			// let's ignore the error if we are the ones who explicitly closed the
+			// socket.
+			select {
+			case <-quitting:
+				err = nil
+			default:
+			}
 		}
 	}
 
-	srv.shutdown(shutdown, kill)
+	srv.shutdown(r)
+	<-r.managed
+	// contexts are only cancelled once the connection manager is done, so
+	// that connections whose handlers return early are still counted as
+	// killed.
+	r.cancel()
+	srv.endShutdownSpan(r)
+	// a forced shutdown does not wait for deregistration.
+	srv.deregister(context.Background(), r)
+
+	// Stop handling signals, so that the next run starts afresh.
+	close(finished)
+	<-interruptDone
+	if !srv.NoSignalHandling {
+		signalStop(interrupt)
+	}
+	srv.finish(r)
 
 	return err
 }
 
+// Signal delivers sig to the server as if it had been received from the
+// operating system, triggering the action configured for it in Signals. It
+// does nothing if the server has stopped.
+func (srv *Server) Signal(sig os.Signal) {
+	if srv.State() == StateStopped {
+		return
+	}
+	srv.interruptChan() <- sig
+}
+
 // Stop instructs the type to halt operations and close
 // the stop channel when it is finished.
 //
 // timeout is grace period for which to wait before shutting
 // down the server. The timeout value passed here will override the
 // timeout given when constructing the server, as this is an explicit
-// command to stop the server.
+// command to stop the server. If the server is already draining, its
+// connections are instead killed once timeout has elapsed from the call,
+// or never if it is zero. Stop does nothing if the server is already
+// being killed or has stopped.
 func (srv *Server) Stop(timeout time.Duration) {
 	srv.stopLock.Lock()
 	defer srv.stopLock.Unlock()
 
-	srv.Timeout = timeout
-	sendSignalInt(srv.interruptChan())
+	switch srv.State() {
+	case StateKilling, StateStopped:
+		return
+	case StateDraining:
+		if r, ok := srv.run.Load().(*run); ok {
+			// replace the timeout of a previous Stop the shutdown has not
+			// seen yet.
+			select {
+			case <-r.stop:
+			default:
+			}
+			r.stop <- timeout
+		}
+		return
+	}
+
+	srv.stopTimeout = &timeout
+	sendStopSignal(srv.interruptChan())
+}
+
+// Drain initiates a graceful shutdown of the server with its Timeout, as if
+// it had been interrupted. BeforeShutdown may still veto the shutdown.
+// Draining a server which is already draining forces it to stop, unless
+// IgnoreRepeatedSignals is set.
+func (srv *Server) Drain() {
+	srv.stopLock.Lock()
+	defer srv.stopLock.Unlock()
+
+	switch srv.State() {
+	case StateKilling, StateStopped:
+		return
+	}
+
+	sendStopSignal(srv.interruptChan())
 }
 
 // StopChan gets the stop channel which will block until
@@ -358,27 +648,61 @@ func DefaultLogger() *log.Logger {
 	return log.New(os.Stderr, "[graceful] ", 0)
 }
 
-func (srv *Server) manageConnections(add, idle, active, remove chan net.Conn, shutdown chan chan struct{}, kill chan struct{}) {
+func (srv *Server) manageConnections(r *run) {
 	var done chan struct{}
 	srv.connections = map[net.Conn]struct{}{}
 	srv.idleConnections = map[net.Conn]struct{}{}
+	srv.connInfo = map[net.Conn]*connInfo{}
+	srv.keptAlive = newIdleQueue()
+	srv.newConnections = map[net.Conn]struct{}{}
+	clock := srv.clock()
+	var sweep <-chan time.Time
+	interval := srv.sweepInterval()
+	if interval > 0 {
+		sweep = clock.After(interval)
+	}
 	for {
+		r.openCount.Store(int64(len(srv.connections)))
+		r.idleCount.Store(int64(len(srv.idleConnections)))
 		select {
-		case conn := <-add:
+		case conn := <-r.add:
 			srv.connections[conn] = struct{}{}
 			srv.idleConnections[conn] = struct{}{} // Newly-added connections are considered idle until they become active.
-		case conn := <-idle:
-			srv.idleConnections[conn] = struct{}{}
-		case conn := <-active:
+			srv.connInfo[conn] = srv.newConnInfo(clock.Now())
+			srv.newConnection(conn)
+		case conn := <-r.idle:
+			// connections killed by a previous run are not tracked.
+			if _, ok := srv.connections[conn]; ok {
+				srv.idleConnections[conn] = struct{}{}
+				srv.closeRecycled(r, conn)
+				srv.keepAlive(r, conn, clock.Now())
+			}
+		case conn := <-r.active:
 			delete(srv.idleConnections, conn)
-		case conn := <-remove:
+			srv.keptAlive.remove(conn)
+			delete(srv.newConnections, conn)
+			if info := srv.connInfo[conn]; info != nil {
+				info.requests++
+				if max := srv.MaxRequestsPerConnection; max > 0 && info.requests >= max {
+					srv.markRecycled(r, conn, "requests")
+				}
+			}
+		case <-sweep:
+			srv.sweep(r, clock.Now())
+			sweep = clock.After(interval)
+		case conn := <-r.remove:
 			delete(srv.connections, conn)
 			delete(srv.idleConnections, conn)
+			delete(srv.connInfo, conn)
+			srv.keptAlive.remove(conn)
+			delete(srv.newConnections, conn)
+			r.recycled.Delete(conn)
 			if done != nil && len(srv.connections) == 0 {
 				done <- struct{}{}
 				return
 			}
-		case done = <-shutdown:
+		case done = <-r.shutdown:
+			r.report.Connections = len(srv.connections)
 			if len(srv.connections) == 0 && len(srv.idleConnections) == 0 {
 				done <- struct{}{}
 				return
@@ -388,20 +712,70 @@ func (srv *Server) manageConnections(add, idle, active, remove chan net.Conn, sh
 			// connections from holding the server open while waiting for them to
 			// hit their idle timeout.
 			for k := range srv.idleConnections {
-				if err := k.Close(); err != nil {
-					srv.logf("[ERROR] %s", err)
+				r.report.IdleClosed++
+				srv.traceClosed(r, k, false)
+				srv.closeConn(k)
+			}
+			if n := len(srv.idleConnections); n > 0 {
+				srv.log(LevelDebug, "idle connections closed", "count", n)
+				srv.emit(Event{Kind: EventIdleClosed, Count: n})
+			}
+		case t := <-r.deadline:
+			// close connections which went idle since the shutdown began, and
+			// make pending reads and writes on the others fail by t.
+			idle := 0
+			for k := range srv.connections {
+				if _, ok := srv.idleConnections[k]; ok {
+					idle++
+					srv.traceClosed(r, k, false)
+					srv.closeConn(k)
+					continue
 				}
+				if err := k.SetDeadline(t); err != nil {
+					srv.log(LevelError, "set deadline failed", "remote", k.RemoteAddr(), "error", err)
+				}
+			}
+			r.report.IdleClosed += idle
+			srv.log(LevelDebug, "connection deadlines set", "deadline", t)
+			if idle > 0 {
+				srv.log(LevelDebug, "idle connections closed", "count", idle)
+				srv.emit(Event{Kind: EventIdleClosed, Count: idle})
 			}
-		case <-kill:
+		case reply := <-r.closeAll:
+			// no request is in flight, so HTTP/2 connections are idle even
+			// though net/http considers them active. Other active
+			// connections have read a request which has yet to reach the
+			// Handler, and close once it is answered. Requests beginning
+			// meanwhile wait for the connections to be closed.
+			closed := 0
+			reply <- srv.requests.ifIdle(func() {
+				for k := range srv.connections {
+					_, idle := srv.idleConnections[k]
+					if _, multiplexed := r.multiplexed.Load(k); idle || multiplexed {
+						closed++
+						srv.traceClosed(r, k, false)
+						srv.closeConn(k)
+					}
+				}
+			})
+			r.report.IdleClosed += closed
+			if closed > 0 {
+				srv.log(LevelDebug, "idle connections closed", "count", closed)
+				srv.emit(Event{Kind: EventIdleClosed, Count: closed})
+			}
+		case <-r.kill:
 			srv.stopLock.Lock()
 			defer srv.stopLock.Unlock()
 
-			srv.Server.ConnState = nil
+			r.report.Killed = len(srv.connections)
 			for k := range srv.connections {
-				if err := k.Close(); err != nil {
-					srv.logf("[ERROR] %s", err)
-				}
+				srv.traceClosed(r, k, true)
+				srv.closeConn(k)
+			}
+			if r.report.Killed > 0 {
+				srv.log(LevelWarn, "connections killed", "count", r.report.Killed)
 			}
+			srv.emit(Event{Kind: EventKilled, Count: r.report.Killed})
 			return
 		}
 	}
@@ -418,63 +792,283 @@ func (srv *Server) interruptChan() chan os.Signal {
 	return srv.interrupt
 }
 
-func (srv *Server) handleInterrupt(interrupt chan os.Signal, quitting chan struct{}, listener net.Listener) {
-	for _ = range interrupt {
-		if srv.Interrupted {
-			srv.logf("already shutting down")
+// signals returns the signals graceful should be notified of.
+func (srv *Server) signals() []os.Signal {
+	if srv.Signals == nil {
+		return defaultSignals()
+	}
+	signals := make([]os.Signal, 0, len(srv.Signals))
+	for sig := range srv.Signals {
+		signals = append(signals, sig)
+	}
+	return signals
+}
+
+// stopSignal is sent by Stop and Drain. It cannot be configured in Signals,
+// so it always drains the server, however the real signals are mapped.
+type stopSignal struct{}
+
+func (stopSignal) String() string { return "stop" }
+func (stopSignal) Signal()        {}
+
+// signalAction returns the action to take for sig. Signals which have not
+// been configured drain the server.
+func (srv *Server) signalAction(sig os.Signal) SignalAction {
+	if _, ok := sig.(stopSignal); ok {
+		return SignalDrain
+	}
+	if action, ok := srv.Signals[sig]; ok {
+		return action
+	}
+	return SignalDrain
+}
+
+func (srv *Server) handleInterrupt(interrupt chan os.Signal, quitting, finished chan struct{}, listener net.Listener, r *run) {
+	// delayed is closed once the shutdown delay is over, and skipDelay cuts
+	// it short. Both are nil unless the shutdown is being delayed.
+	var delayed <-chan struct{}
+	var skipDelay context.CancelFunc
+	for {
+		var sig os.Signal
+		select {
+		case sig = <-interrupt:
+		case <-delayed:
+			delayed, skipDelay = nil, nil
+			srv.closeListener(quitting, listener, r)
 			continue
+		case <-finished:
+			if skipDelay != nil {
+				skipDelay()
+			}
+			return
 		}
-		srv.logf("shutdown initiated")
-		srv.Interrupted = true
-		if srv.BeforeShutdown != nil {
-			if !srv.BeforeShutdown() {
-				srv.Interrupted = false
+
+		state := srv.State()
+		srv.log(LevelDebug, "signal received", "signal", sig, "state", state)
+		srv.emit(Event{Kind: EventSignal, Signal: sig})
+		switch srv.signalAction(sig) {
+		case SignalIgnore:
+			continue
+		case SignalReload:
+			srv.log(LevelInfo, "reload requested")
+			if srv.Reload != nil {
+				srv.Reload()
+			}
+			continue
+		case SignalCustom:
+			if srv.SignalFunc != nil {
+				srv.SignalFunc(sig)
+			}
+			continue
+		case SignalKill:
+			if state == StateKilling {
+				srv.log(LevelInfo, "already shutting down")
 				continue
 			}
-		}
+		case SignalDrain:
+			if state == StateKilling || (state == StateDraining && srv.IgnoreRepeatedSignals) {
+				srv.log(LevelInfo, "already shutting down")
+				continue
+			}
+			if delayed != nil {
+				// a repeated signal skips the delay rather than the drain.
+				if srv.IgnoreRepeatedSignals {
+					srv.log(LevelInfo, "already shutting down")
+				} else {
+					srv.log(LevelInfo, "shutdown delay skipped")
+					skipDelay()
+				}
+				continue
+			}
+			if state == StateServing || state == StatePaused {
+				srv.log(LevelInfo, "shutdown initiated")
+				// a paused server was already allowed to shut down.
+				if srv.BeforeShutdown != nil && state == StateServing {
+					if !srv.BeforeShutdown() {
+						srv.log(LevelInfo, "shutdown vetoed by BeforeShutdown")
+						continue
+					}
+				}
+				srv.emit(Event{Kind: EventDrainStarted, Count: int(r.openCount.Load())})
+				srv.shutdownSpan(r)
 
-		close(quitting)
-		srv.SetKeepAlivesEnabled(false)
-		if err := listener.Close(); err != nil {
-			srv.logf("[ERROR] %s", err)
+				if srv.delaysShutdown(r) {
+					delayed, skipDelay = srv.delayShutdown(r)
+					continue
+				}
+				srv.closeListener(quitting, listener, r)
+				continue
+			}
 		}
 
-		if srv.ShutdownInitiated != nil {
-			srv.ShutdownInitiated()
+		// Either a kill signal was received, or a drain signal was
+		// received while already draining: stop right away.
+		srv.log(LevelWarn, "forced shutdown initiated")
+		srv.shutdownSpan(r).AddEvent("forced", Attr("graceful.signal", sig.String()))
+		if delayed != nil {
+			skipDelay()
+			delayed, skipDelay = nil, nil
+		}
+		if state == StateServing || state == StatePaused {
+			srv.closeListener(quitting, listener, r)
 		}
+		srv.forceKill(r)
 	}
 }
 
-func (srv *Server) logf(format string, args ...interface{}) {
-	if srv.LogFunc != nil {
-		srv.LogFunc(format, args...)
-	} else if srv.Logger != nil {
-		srv.Logger.Printf(format, args...)
+// closeListener stops the server from accepting new connections.
+func (srv *Server) closeListener(quitting chan struct{}, listener net.Listener, r *run) {
+	close(quitting)
+	srv.drain()
+	srv.backend().setDraining(true)
+	// keep-alives are disabled first, so that connections close once the
+	// requests cancelled by the drain end.
+	r.drainCancel()
+	if n := srv.streams.Load(); n > 0 {
+		srv.log(LevelDebug, "streams notified", "count", n)
+	}
+	if err := listener.Close(); err != nil {
+		srv.log(LevelError, "close listener failed", "addr", listener.Addr(), "error", err)
+	} else {
+		srv.log(LevelDebug, "listener closed", "addr", listener.Addr())
+	}
+	srv.emit(Event{Kind: EventListenerClosed})
+
+	if srv.ShutdownInitiated != nil {
+		srv.ShutdownInitiated()
 	}
 }
 
-func (srv *Server) shutdown(shutdown chan chan struct{}, kill chan struct{}) {
-	// Request done notification
-	done := make(chan struct{})
-	shutdown <- done
+// closeConn closes a connection on behalf of the connection manager.
+func (srv *Server) closeConn(conn net.Conn) {
+	if err := conn.Close(); err != nil {
+		srv.log(LevelError, "close failed", "remote", conn.RemoteAddr(), "error", err)
+	}
+}
 
+func (srv *Server) shutdown(r *run) {
+	// Request done notification. The connection manager is no longer
+	// listening if the server has already been killed.
+	done := make(chan struct{}, 1)
+	select {
+	case r.shutdown <- done:
+	case <-r.kill:
+	}
+	// the listener is closed by now, however the server stopped.
+	r.drainCancel()
+
+	clock := srv.clock()
+	start := clock.Now()
+	r.report.Started = start
+	var spent time.Duration
+	if delayStarted, delay, ok := r.delayed(); ok {
+		r.report.Started = delayStarted
+		r.report.Delay = delay
+		r.report.Stages = append(r.report.Stages, StageDelay)
+		spent = start.Sub(delayStarted)
+	}
+	srv.stageReached(r, StageDrain)
+	// stopLock is not held while waiting, so that Stop and Drain can still
+	// reach a draining server.
 	srv.stopLock.Lock()
-	defer srv.stopLock.Unlock()
-	if srv.Timeout > 0 {
+	stages := srv.shutdownStages(spent)
+	srv.stopLock.Unlock()
+	hard := hardDeadline(stages)
+	var requestsDone <-chan struct{}
+	if srv.WaitForRequests {
+		requestsDone = srv.requests.done()
+	}
+	// the grace of routes cannot extend the shutdown past its budget.
+	var graceLimit time.Duration
+	if budget := srv.ShutdownBudget; budget > 0 {
+		graceLimit = budget - spent
+	}
+wait:
+	for {
+		var next <-chan time.Time
+		var graceChanged <-chan struct{}
+		if len(stages) > 0 {
+			// requests of routes with an extended grace hold the next stage
+			// back until they finish.
+			after := stages[0].after
+			var grace time.Duration
+			grace, graceChanged = srv.grace.max()
+			if graceLimit > 0 && grace > graceLimit {
+				grace = graceLimit
+			}
+			if grace > after {
+				after = grace
+			}
+			next = clock.After(after - clock.Now().Sub(start))
+		}
 		select {
+		case <-graceChanged:
+			continue
+		case timeout := <-r.stop:
+			var kill time.Duration
+			if timeout > 0 {
+				kill = clock.Now().Sub(start) + timeout
+			}
+			stages = srv.stopStages(stages, kill, spent)
+			hard = hardDeadline(stages)
+			srv.log(LevelDebug, "shutdown timeout changed", "timeout", timeout)
+			continue
 		case <-done:
-		case <-time.After(srv.Timeout):
-			close(kill)
+			break wait
+		case <-r.kill:
+			// killed by a signal rather than by the hard deadline.
+			srv.reportBlocking(r)
+			srv.stageReached(r, StageKill)
+			break wait
+		case <-requestsDone:
+			requestsDone = nil
+			srv.log(LevelDebug, "requests finished")
+			closed := make(chan bool, 1)
+			select {
+			case r.closeAll <- closed:
+				if !<-closed {
+					// a request began since, so wait for it too.
+					requestsDone = srv.requests.done()
+				}
+			case <-done:
+				break wait
+			case <-r.kill:
+			}
+			continue
+		case <-next:
+		}
+
+		current := stages[0]
+		stages = stages[1:]
+		srv.stageReached(r, current.stage)
+		switch current.stage {
+		case StageCancel:
+			r.cancel()
+		case StageDeadline:
+			// connection deadlines are always in wall clock time.
+			t := time.Now()
+			if hard > 0 {
+				t = t.Add(hard - clock.Now().Sub(start))
+			}
+			select {
+			case r.deadline <- t:
+			case <-done:
+			case <-r.kill:
+			}
+		case StageKill:
+			srv.reportBlocking(r)
+			srv.emit(Event{Kind: EventTimeout})
+			srv.forceKill(r)
+			break wait
 		}
-	} else {
-		<-done
-	}
-	// Close the stopChan to wake up any blocked goroutines.
-	srv.chanLock.Lock()
-	if srv.stopChan != nil {
-		close(srv.stopChan)
 	}
-	srv.chanLock.Unlock()
+	r.report.Finished = clock.Now()
+}
+
+func (srv *Server) stageReached(r *run, stage ShutdownStage) {
+	r.report.Stages = append(r.report.Stages, stage)
+	srv.shutdownSpan(r).AddEvent("stage", Attr("graceful.stage", stage.String()))
+	srv.notifyStage(stage)
 }
 
 func (srv *Server) newTCPListener(addr string) (net.Listener, error) {
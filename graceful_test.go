@@ -2,6 +2,7 @@ package graceful
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -12,9 +13,12 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
 )
 
 const (
@@ -171,10 +175,11 @@ func TestGracefulRunTimesOut(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	clock := fakeclock.New(time.Now())
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		srv := &Server{Timeout: killTime, Server: server, interrupt: c}
+		srv := &Server{Timeout: time.Minute, Clock: clock, Server: server, interrupt: c}
 		srv.Serve(l)
 	}()
 
@@ -196,6 +201,10 @@ func TestGracefulRunTimesOut(t *testing.T) {
 			wg.Add(1)
 			go runQuery(t, 0, true, &wg, &once)
 		}
+
+		// The requests outlast the timeout, which elapses at once.
+		clock.BlockUntil(1)
+		clock.Advance(time.Minute)
 	}()
 }
 
@@ -593,6 +602,283 @@ func TestStopRace(t *testing.T) {
 	}
 }
 
+func TestRestartAfterStop(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			if l, err = net.Listen("tcp", fmt.Sprintf(":%d", port)); err != nil {
+				t.Fatalf("run %d: %s", i, err)
+			}
+		}
+
+		served := make(chan error, 1)
+		go func() { served <- srv.Serve(l) }()
+		time.Sleep(waitTime)
+
+		var wg sync.WaitGroup
+		var once sync.Once
+		wg.Add(1)
+		runQuery(t, http.StatusOK, false, &wg, &once)
+
+		srv.Stop(killTime)
+		select {
+		case <-srv.StopChan():
+		case <-time.After(timeoutTime):
+			t.Fatalf("run %d: Timed out while waiting for explicit stop to complete", i)
+		}
+		if err := <-served; err != nil {
+			t.Fatalf("run %d: Serve returned %s", i, err)
+		}
+	}
+}
+
+func TestRestartAfterKill(t *testing.T) {
+	var slow int32 = 1
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&slow) == 1 {
+			time.Sleep(killTime * 10)
+		}
+		rw.WriteHeader(http.StatusOK)
+	})}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := make(chan os.Signal, 1)
+	clock := fakeclock.New(time.Now())
+	srv := &Server{Timeout: time.Minute, Clock: clock, Server: server, interrupt: c}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-srv.StopChan()
+	wg.Wait()
+
+	// Serve again with a fast handler on a new listener.
+	atomic.StoreInt32(&slow, 0)
+	l, err = net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	select {
+	case <-srv.StopChan():
+		t.Fatal("stop channel should be reset when serving again")
+	default:
+	}
+
+	wg.Add(1)
+	runQuery(t, http.StatusOK, false, &wg, &once)
+
+	c <- os.Interrupt
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the restarted server to stop")
+	}
+}
+
+func TestServeWhileRunning(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Server: server, NoSignalHandling: true}
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+
+	if err := srv.Serve(l); err != ErrServerRunning {
+		t.Fatalf("expected ErrServerRunning, got %v", err)
+	}
+
+	srv.Stop(0)
+	<-srv.StopChan()
+}
+
+func TestStateTransitions(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := fakeclock.New(time.Now())
+	srv := &Server{Timeout: time.Minute, Clock: clock, Server: server, interrupt: c}
+	if state := srv.State(); state != StateIdle {
+		t.Fatalf("expected a new server to be idle, got %s", state)
+	}
+
+	var transitionLock sync.Mutex
+	var transitions []Transition
+	unsubscribe := srv.Subscribe(func(tr Transition) {
+		transitionLock.Lock()
+		transitions = append(transitions, tr)
+		transitionLock.Unlock()
+	})
+	defer unsubscribe()
+
+	go srv.Serve(l)
+	time.Sleep(waitTime)
+	if state := srv.State(); state != StateServing {
+		t.Fatalf("expected the server to be serving, got %s", state)
+	}
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	wg.Add(1)
+	go runQuery(t, 0, true, &wg, &once)
+	time.Sleep(waitTime)
+
+	c <- os.Interrupt
+	time.Sleep(waitTime)
+	if state := srv.State(); state != StateDraining {
+		t.Fatalf("expected the server to be draining, got %s", state)
+	}
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-srv.StopChan()
+	wg.Wait()
+	if state := srv.State(); state != StateStopped {
+		t.Fatalf("expected the server to be stopped, got %s", state)
+	}
+
+	transitionLock.Lock()
+	defer transitionLock.Unlock()
+	expected := []Transition{
+		{StateIdle, StateServing},
+		{StateServing, StateDraining},
+		{StateDraining, StateKilling},
+		{StateKilling, StateStopped},
+	}
+	if !reflect.DeepEqual(transitions, expected) {
+		t.Errorf("Incorrect state transitions.\n  actual: %v\nexpected: %v\n", transitions, expected)
+	}
+}
+
+// Run with --race
+func TestStateChurn(t *testing.T) {
+	server, l, err := createListener(1 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{Timeout: killTime, Server: server, NoSignalHandling: true}
+
+	var states int32
+	srv.Subscribe(func(Transition) { atomic.AddInt32(&states, 1) })
+
+	for i := 0; i < 5; i++ {
+		if i > 0 {
+			if l, err = net.Listen("tcp", fmt.Sprintf(":%d", port)); err != nil {
+				t.Fatalf("run %d: %s", i, err)
+			}
+		}
+
+		served := make(chan struct{})
+		go func() {
+			srv.Serve(l)
+			close(served)
+		}()
+
+		var wg sync.WaitGroup
+		for j := 0; j < concurrentRequestN; j++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				resp, err := http.Get(fmt.Sprintf("http://localhost:%d", port))
+				if err == nil {
+					resp.Body.Close()
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for srv.State() != StateStopped {
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+
+		time.Sleep(waitTime / 10)
+		for j := 0; j < 3; j++ {
+			go srv.Stop(killTime)
+		}
+
+		select {
+		case <-served:
+		case <-time.After(timeoutTime):
+			t.Fatalf("run %d: Timed out while waiting for the server to stop", i)
+		}
+		wg.Wait()
+	}
+
+	if atomic.LoadInt32(&states) < 10 {
+		t.Errorf("expected at least 10 transitions, got %d", states)
+	}
+}
+
+func TestPipeListener(t *testing.T) {
+	pl := NewPipeListener()
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		time.Sleep(waitTime)
+		rw.WriteHeader(http.StatusOK)
+	})}
+
+	c := make(chan os.Signal, 1)
+	srv := &Server{
+		Timeout:     killTime,
+		ListenLimit: concurrentRequestN / 2,
+		Server:      server,
+		interrupt:   c,
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(keepAliveListener{pl, time.Minute}) }()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: pl.DialContext}}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get("http://pipe/")
+			if err != nil {
+				t.Errorf("Get failed: %v", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("Incorrect status code on response. Expected %d. Got %d", http.StatusOK, resp.StatusCode)
+			}
+		}()
+	}
+	wg.Wait()
+
+	c <- os.Interrupt
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve returned %s", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+
+	if _, err := pl.Dial(); err == nil {
+		t.Fatal("expected dialing a closed listener to fail")
+	}
+}
+
 func TestInterruptLog(t *testing.T) {
 	c := make(chan os.Signal, 1)
 
@@ -635,21 +921,35 @@ func TestMultiInterrupts(t *testing.T) {
 	logger := log.New(&buf, "", 0)
 	expected := log.New(&tbuf, "", 0)
 
-	srv := &Server{Timeout: killTime, Server: server, Logger: logger, interrupt: c}
+	clock := fakeclock.New(time.Now())
+	srv := &Server{Timeout: time.Minute, Clock: clock, Server: server, Logger: logger, interrupt: c, IgnoreRepeatedSignals: true}
 	go func() { srv.Serve(l) }()
 
+	// Keep the server draining while the interrupts are delivered.
+	var qwg sync.WaitGroup
+	var once sync.Once
+	qwg.Add(1)
+	go runQuery(t, 0, true, &qwg, &once)
+	time.Sleep(waitTime)
+
 	stop := srv.StopChan()
-	buf.Add(1 + 10) // Expecting 11 log calls
+	buf.Add(1 + 10) // Expecting 11 log calls before the kill
 	c <- os.Interrupt
 	expected.Printf("shutdown initiated")
 	for i := 0; i < 10; i++ {
 		c <- os.Interrupt
 		expected.Printf("already shutting down")
 	}
+	wg.Wait()
 
+	buf.Add(1)
+	expected.Printf("[WARN] connections killed count=1")
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
 	<-stop
 
 	wg.Wait()
+	qwg.Wait()
 	bb, bt := buf.Bytes(), tbuf.Bytes()
 	for i, b := range bb {
 		if b != bt[i] {
@@ -658,6 +958,335 @@ func TestMultiInterrupts(t *testing.T) {
 	}
 }
 
+func TestRepeatedInterruptForcesShutdown(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Timeout: 0, Server: server, interrupt: c}
+	go srv.Serve(l)
+
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, 0, true, &wg, &once)
+	}
+
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for forced shutdown to complete")
+	}
+}
+
+func TestSignalActions(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := make(chan struct{}, 1)
+	custom := make(chan os.Signal, 1)
+	srv := &Server{
+		Timeout: 0,
+		Server:  server,
+		Signals: map[os.Signal]SignalAction{
+			syscall.SIGHUP:  SignalReload,
+			syscall.SIGUSR1: SignalCustom,
+			syscall.SIGUSR2: SignalIgnore,
+			syscall.SIGQUIT: SignalKill,
+		},
+		Reload:     func() { reloaded <- struct{}{} },
+		SignalFunc: func(sig os.Signal) { custom <- sig },
+		interrupt:  c,
+	}
+	go srv.Serve(l)
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, 0, true, &wg, &once)
+	}
+	time.Sleep(waitTime)
+
+	c <- syscall.SIGHUP
+	select {
+	case <-reloaded:
+	case <-time.After(timeoutTime):
+		t.Fatal("Reload was not called")
+	}
+
+	c <- syscall.SIGUSR1
+	select {
+	case sig := <-custom:
+		if sig != syscall.SIGUSR1 {
+			t.Fatalf("SignalFunc called with %s, expected %s", sig, syscall.SIGUSR1)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("SignalFunc was not called")
+	}
+
+	c <- syscall.SIGUSR2
+
+	c <- syscall.SIGQUIT
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for kill signal to stop the server")
+	}
+	wg.Wait()
+}
+
+func TestStopIgnoresSignalActions(t *testing.T) {
+	for _, action := range []SignalAction{SignalReload, SignalIgnore} {
+		for name, stop := range map[string]func(*Server){
+			"Stop":  func(srv *Server) { srv.Stop(0) },
+			"Drain": (*Server).Drain,
+		} {
+			var reloads int32
+			srv := &Server{
+				Timeout:          killTime,
+				NoSignalHandling: true,
+				Signals:          map[os.Signal]SignalAction{syscall.SIGINT: action},
+				Reload:           func() { atomic.AddInt32(&reloads, 1) },
+				Server:           &http.Server{Handler: http.NotFoundHandler()},
+			}
+			go srv.Serve(NewPipeListener())
+			for srv.State() != StateServing {
+				time.Sleep(time.Millisecond)
+			}
+
+			stop(srv)
+			select {
+			case <-srv.StopChan():
+			case <-time.After(timeoutTime):
+				t.Fatalf("%s did not stop a server with SIGINT mapped to %d", name, action)
+			}
+			if n := atomic.LoadInt32(&reloads); n != 0 {
+				t.Fatalf("%s called Reload %d times", name, n)
+			}
+		}
+	}
+}
+
+func TestShutdownPolicyCancelsContexts(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c := make(chan os.Signal, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		rw.WriteHeader(http.StatusOK)
+	})
+	server := &http.Server{Handler: mux}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stageLock sync.Mutex
+	var stages []ShutdownStage
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Timeout: time.Hour,
+		Clock:   clock,
+		ShutdownPolicy: &ShutdownPolicy{
+			CancelAfter:   time.Second,
+			DeadlineAfter: time.Minute,
+		},
+		StageReached: func(stage ShutdownStage) {
+			stageLock.Lock()
+			stages = append(stages, stage)
+			stageLock.Unlock()
+		},
+		Server:    server,
+		interrupt: c,
+	}
+	go srv.Serve(l)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var once sync.Once
+		wg.Add(1)
+		runQuery(t, http.StatusOK, false, &wg, &once)
+	}()
+
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for cancelled requests to complete")
+	}
+
+	stageLock.Lock()
+	defer stageLock.Unlock()
+	expected := []ShutdownStage{StageDrain, StageCancel}
+	if !reflect.DeepEqual(stages, expected) {
+		t.Errorf("Incorrect shutdown stages.\n  actual: %v\nexpected: %v\n", stages, expected)
+	}
+}
+
+func TestHTTPServerBaseContext(t *testing.T) {
+	type key struct{}
+	pl := NewPipeListener()
+	values := make(chan interface{}, 1)
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		NoSignalHandling: true,
+		Clock:            clock,
+		ShutdownPolicy:   &ShutdownPolicy{CancelAfter: time.Second},
+		Server: &http.Server{
+			BaseContext: func(net.Listener) context.Context {
+				return context.WithValue(context.Background(), key{}, "base")
+			},
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				values <- r.Context().Value(key{})
+				<-r.Context().Done()
+			}),
+		},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	select {
+	case v := <-values:
+		if v != "base" {
+			t.Fatalf("expected the request context to derive from the http.Server's BaseContext, got %v", v)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the request")
+	}
+
+	// The request context is still cancelled by the shutdown.
+	srv.Stop(time.Minute)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 0 {
+		t.Fatalf("expected the request to end when its context was cancelled, got %+v", report)
+	}
+}
+
+func TestShutdownPolicyEscalates(t *testing.T) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c := make(chan os.Signal, 1)
+	server, l, err := createListener(killTime * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stageLock sync.Mutex
+	var stages []ShutdownStage
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Clock: clock,
+		ShutdownPolicy: &ShutdownPolicy{
+			CancelAfter:   time.Second,
+			DeadlineAfter: 2 * time.Second,
+			KillAfter:     time.Minute,
+		},
+		StageReached: func(stage ShutdownStage) {
+			stageLock.Lock()
+			stages = append(stages, stage)
+			stageLock.Unlock()
+		},
+		Server:    server,
+		interrupt: c,
+	}
+	go srv.Serve(l)
+
+	var once sync.Once
+	for i := 0; i < concurrentRequestN; i++ {
+		wg.Add(1)
+		go runQuery(t, 0, true, &wg, &once)
+	}
+
+	time.Sleep(waitTime)
+	c <- os.Interrupt
+
+	// Every stage is due at once.
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the shutdown to escalate")
+	}
+
+	stageLock.Lock()
+	defer stageLock.Unlock()
+	expected := []ShutdownStage{StageDrain, StageCancel, StageDeadline, StageKill}
+	if !reflect.DeepEqual(stages, expected) {
+		t.Errorf("Incorrect shutdown stages.\n  actual: %v\nexpected: %v\n", stages, expected)
+	}
+}
+
+func TestStopOverridesKillAfter(t *testing.T) {
+	pl := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		ShutdownPolicy:   &ShutdownPolicy{KillAfter: time.Hour},
+		Clock:            clock,
+		NoSignalHandling: true,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	srv.Stop(time.Minute)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for Stop's timeout to kill the request")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 1 {
+		t.Errorf("expected 1 connection to be killed, got %d", report.Killed)
+	}
+}
+
 func TestLogFunc(t *testing.T) {
 	c := make(chan os.Signal, 1)
 
@@ -690,3 +1319,449 @@ func (buf *SyncBuffer) Write(b []byte) (int, error) {
 	defer buf.Done()
 	return buf.Buffer.Write(b)
 }
+
+func TestPauseAndResume(t *testing.T) {
+	pl := NewPipeListener()
+	var vetoes, calls int32
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		BeforeShutdown: func() bool {
+			atomic.AddInt32(&calls, 1)
+			return atomic.AddInt32(&vetoes, -1) < 0
+		},
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})},
+	}
+	go srv.Serve(pl)
+	for srv.State() != StateServing {
+		time.Sleep(time.Millisecond)
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialContext: pl.DialContext, DisableKeepAlives: true}}
+	get := func() error {
+		resp, err := client.Get("http://pipe/")
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	atomic.StoreInt32(&vetoes, 1)
+	if err := srv.Pause(); err != ErrShutdownVetoed {
+		t.Fatalf("expected the pause to be vetoed, got %v", err)
+	}
+	if err := srv.Resume(); err != ErrNotPaused {
+		t.Fatalf("expected resuming a serving server to fail, got %v", err)
+	}
+
+	if err := srv.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err == nil {
+		t.Fatal("expected a paused server to reject connections")
+	}
+	if err := srv.Resume(); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err != nil {
+		t.Fatalf("expected a resumed server to serve, got %v", err)
+	}
+
+	if err := srv.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Stop(killTime)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+	if err := srv.Pause(); err != ErrNotServing {
+		t.Fatalf("expected pausing a stopped server to fail, got %v", err)
+	}
+	// BeforeShutdown is not asked again when a paused server is stopped.
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected BeforeShutdown to be called 3 times, got %d", n)
+	}
+}
+
+func TestRepeatedDrainForcesShutdown(t *testing.T) {
+	pl := NewPipeListener()
+	srv := &Server{
+		NoSignalHandling: true,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	// Without a timeout, the request holds the drain until it is forced.
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	srv.Drain()
+	for srv.State() != StateDraining {
+		time.Sleep(time.Millisecond)
+	}
+	drained := make(chan struct{})
+	go func() {
+		srv.Drain()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while draining a draining server")
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for forced shutdown to complete")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 1 {
+		t.Fatalf("expected the active connection to be killed, got %+v", report)
+	}
+}
+
+func TestShutdownDelay(t *testing.T) {
+	pl := NewPipeListener()
+	deregistered := make(chan struct{})
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Timeout:          time.Minute,
+		Clock:            clock,
+		NoSignalHandling: true,
+		ShutdownDelay:    time.Minute,
+		ShutdownDelayFunc: func(ctx context.Context) error {
+			close(deregistered)
+			return nil
+		},
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})},
+	}
+	go srv.Serve(pl)
+	for srv.State() != StateServing {
+		time.Sleep(time.Millisecond)
+	}
+
+	srv.Stop(time.Minute)
+	<-deregistered
+
+	// The server keeps accepting connections during the delay.
+	clock.BlockUntil(1)
+	client := &http.Client{Transport: &http.Transport{DialContext: pl.DialContext, DisableKeepAlives: true}}
+	resp, err := client.Get("http://pipe/")
+	if err != nil {
+		t.Fatalf("expected the server to serve during the delay, got %v", err)
+	}
+	resp.Body.Close()
+	if state := srv.State(); state != StateServing {
+		t.Fatalf("expected the server to serve until the end of the delay, got %s", state)
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+	report := srv.ShutdownReport()
+	if report.Delay != time.Minute {
+		t.Errorf("expected a delay of %s, got %s", time.Minute, report.Delay)
+	}
+	expected := []ShutdownStage{StageDelay, StageDrain}
+	if !reflect.DeepEqual(report.Stages, expected) {
+		t.Errorf("Incorrect shutdown stages.\n  actual: %v\nexpected: %v\n", report.Stages, expected)
+	}
+}
+
+func TestShutdownDelaySkipped(t *testing.T) {
+	c := make(chan os.Signal, 1)
+	srv := &Server{
+		Timeout:       killTime,
+		ShutdownDelay: time.Minute,
+		Server:        &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})},
+		interrupt:     c,
+	}
+	go srv.Serve(NewPipeListener())
+
+	c <- os.Interrupt
+	time.Sleep(waitTime)
+	if state := srv.State(); state != StateServing {
+		t.Fatalf("expected the server to serve during the delay, got %s", state)
+	}
+	c <- os.Interrupt
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the delay to be skipped")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 0 {
+		t.Fatalf("expected the skipped delay not to kill connections, got %+v", report)
+	}
+}
+
+func TestShutdownBudget(t *testing.T) {
+	pl := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Timeout:          time.Minute,
+		Clock:            clock,
+		NoSignalHandling: true,
+		ShutdownDelay:    time.Minute,
+		ShutdownBudget:   time.Second,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})},
+	}
+	go srv.Serve(pl)
+	for srv.State() != StateServing {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A request keeps its connection active.
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	// The budget cuts the delay short, and then leaves no time to drain.
+	srv.Drain()
+	clock.BlockUntil(2)
+	clock.Advance(time.Second)
+	for srv.State() == StateServing {
+		time.Sleep(time.Millisecond)
+	}
+	clock.BlockUntil(2)
+	clock.Advance(time.Second)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the budget to be spent")
+	}
+	report := srv.ShutdownReport()
+	if report.Killed != 1 {
+		t.Fatalf("expected the active connection to be killed, got %+v", report)
+	}
+	if report.Delay != time.Second {
+		t.Fatalf("expected the budget to end the delay after %s, got %s", time.Second, report.Delay)
+	}
+}
+
+func TestRegistrar(t *testing.T) {
+	registrar := &MemoryRegistrar{}
+	var registeredDuringDelay []net.Addr
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Registrar:        registrar,
+		ShutdownDelayFunc: func(ctx context.Context) error {
+			registeredDuringDelay = registrar.Registered()
+			return nil
+		},
+		Server: &http.Server{
+			Addr:    "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		},
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+
+	var addrs []net.Addr
+	for i := 0; i < 100 && len(addrs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		addrs = registrar.Registered()
+	}
+	if len(addrs) != 1 {
+		t.Fatalf("expected the server to be registered, got %v", addrs)
+	}
+	if _, port, _ := net.SplitHostPort(addrs[0].String()); port == "0" {
+		t.Fatalf("expected the resolved address to be registered, got %s", addrs[0])
+	}
+	resp, err := http.Get("http://" + addrs[0].String())
+	if err != nil {
+		t.Fatalf("expected the server to serve on its registered address, got %v", err)
+	}
+	resp.Body.Close()
+
+	srv.Stop(killTime)
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Fatalf("Serve returned %s", err)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+	if len(registeredDuringDelay) != 0 {
+		t.Errorf("expected the server to be deregistered before the delay, got %v", registeredDuringDelay)
+	}
+	if addrs := registrar.Registered(); len(addrs) != 0 {
+		t.Errorf("expected the server to be deregistered, got %v", addrs)
+	}
+}
+
+func TestRegistrarRetries(t *testing.T) {
+	var failures int32 = 2
+	registrar := &MemoryRegistrar{Err: func(op string, addr net.Addr) error {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return fmt.Errorf("%s unavailable", op)
+		}
+		return nil
+	}}
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Registrar:        registrar,
+		Server:           &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {})},
+	}
+	go srv.Serve(NewPipeListener())
+	for i := 0; i < 100 && len(registrar.Registered()) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(registrar.Registered()) != 1 {
+		t.Fatal("expected registration to succeed on the third attempt")
+	}
+	srv.Stop(killTime)
+	<-srv.StopChan()
+
+	// Serve fails once every attempt has failed.
+	atomic.StoreInt32(&failures, 2)
+	srv.RegisterAttempts = 2
+	if err := srv.Serve(NewPipeListener()); err == nil || err.Error() != "register unavailable" {
+		t.Fatalf("expected Serve to fail to register, got %v", err)
+	}
+	if state := srv.State(); state != StateStopped {
+		t.Fatalf("expected the server to be stopped, got %s", state)
+	}
+	select {
+	case <-srv.Failed():
+	default:
+		t.Fatal("expected the server to have failed to start")
+	}
+	if err := srv.StartErr(); err == nil || err.Error() != "register unavailable" {
+		t.Fatalf("expected StartErr to return the registration error, got %v", err)
+	}
+}
+
+func TestReadyAndAddrs(t *testing.T) {
+	listened := make(chan []net.Addr, 1)
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		OnListen:         func(addrs []net.Addr) { listened <- addrs },
+		Server: &http.Server{
+			Addr:    "127.0.0.1:0",
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		},
+	}
+	ready := srv.Ready()
+	if srv.Addrs() != nil {
+		t.Fatal("expected no addresses before serving")
+	}
+	go srv.ListenAndServe()
+
+	select {
+	case <-ready:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to be ready")
+	}
+	addrs := srv.Addrs()
+	if len(addrs) != 1 {
+		t.Fatalf("expected one address, got %v", addrs)
+	}
+	if _, port, _ := net.SplitHostPort(addrs[0].String()); port == "0" {
+		t.Fatalf("expected the address to be resolved, got %s", addrs[0])
+	}
+	if got := <-listened; !reflect.DeepEqual(got, addrs) {
+		t.Fatalf("expected OnListen to be called with %v, got %v", addrs, got)
+	}
+	resp, err := http.Get("http://" + addrs[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	srv.Stop(killTime)
+	<-srv.StopChan()
+	if srv.Addrs() != nil {
+		t.Fatal("expected no addresses once stopped")
+	}
+
+	// A restarted server is ready again once it serves.
+	go srv.Serve(NewPipeListener())
+	<-listened
+	select {
+	case <-srv.Ready():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to be ready again")
+	}
+	if addrs := srv.Addrs(); len(addrs) != 1 || addrs[0].Network() != "pipe" {
+		t.Fatalf("expected the pipe address, got %v", addrs)
+	}
+	srv.Stop(killTime)
+	<-srv.StopChan()
+}
+
+func TestFailedToListen(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	srv := &Server{
+		Timeout:          killTime,
+		NoSignalHandling: true,
+		Server: &http.Server{
+			Addr:    taken.Addr().String(),
+			Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}),
+		},
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+
+	select {
+	case <-srv.Ready():
+		t.Fatal("expected a server which cannot listen not to be ready")
+	case <-srv.Failed():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to fail")
+	}
+	if err := <-errs; err == nil || srv.StartErr() != err {
+		t.Fatalf("expected StartErr to return the error of ListenAndServe %v, got %v", err, srv.StartErr())
+	}
+	select {
+	case <-srv.StopChan():
+	default:
+		t.Fatal("expected the stop channel of a server which failed to start to be closed")
+	}
+
+	// The failure is forgotten once the server serves.
+	go srv.Serve(NewPipeListener())
+	select {
+	case <-srv.Ready():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to be ready")
+	}
+	if srv.StartErr() != nil {
+		t.Fatalf("expected no error once serving, got %v", srv.StartErr())
+	}
+	select {
+	case <-srv.Failed():
+		t.Fatal("expected a serving server not to have failed")
+	case <-srv.StopChan():
+		t.Fatal("expected a serving server not to be stopped")
+	default:
+	}
+	srv.Stop(killTime)
+	<-srv.StopChan()
+}
@@ -0,0 +1,32 @@
+// Package gracefultest provides utilities for testing the shutdown behavior
+// of graceful servers.
+package gracefultest
+
+import (
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+// Clock is a fake graceful.Clock whose time only moves when Advance is
+// called. It lets tests drive shutdown timeouts without sleeping.
+//
+// Besides Now and After, which implement graceful.Clock, it has Advance to
+// move the time forward and fire the timers expiring on the way, Waiters
+// to count the timers which have not fired yet, and BlockUntil to wait
+// until the code under test has started a number of timers.
+//
+// Example:
+//
+//	clock := gracefultest.NewClock(time.Now())
+//	srv := &graceful.Server{Timeout: time.Minute, Clock: clock, Server: server}
+//	go srv.Serve(l)
+//	srv.Stop(time.Minute)
+//	clock.BlockUntil(1)
+//	clock.Advance(time.Minute) // the timeout elapses immediately
+type Clock = fakeclock.Clock
+
+// NewClock returns a fake Clock set to now.
+func NewClock(now time.Time) *Clock {
+	return fakeclock.New(now)
+}
@@ -0,0 +1,56 @@
+package gracefultest
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+func TestServerTimeoutWithClock(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock := NewClock(time.Now())
+	srv := &graceful.Server{
+		Timeout:          time.Hour,
+		Clock:            clock,
+		NoSignalHandling: true,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})},
+	}
+	go srv.Serve(l)
+
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	srv.Stop(time.Hour)
+	clock.BlockUntil(1)
+	select {
+	case <-srv.StopChan():
+		t.Fatal("server stopped before the timeout elapsed")
+	default:
+	}
+
+	clock.Advance(time.Hour)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(time.Second):
+		t.Fatal("Timed out while waiting for the server to be killed")
+	}
+}
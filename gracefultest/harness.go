@@ -0,0 +1,361 @@
+package gracefultest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+// HijackPath is the path on which the handler installed by Start hijacks
+// the connection. Requests to other paths are passed to the server's
+// handler.
+const HijackPath = "/.gracefultest/hijack"
+
+// Harness runs a graceful.Server on a graceful.PipeListener for the duration
+// of a test, and provides helpers to open client connections, interrupt the
+// server and check how it shut down.
+type Harness struct {
+	// Server is the server under test.
+	Server *graceful.Server
+
+	// Listener is the in-memory listener the server is bound to.
+	Listener *graceful.PipeListener
+
+	// Clock is the fake clock installed on the server, or nil if the server
+	// came with a Clock of another type.
+	Clock *Clock
+
+	t      testing.TB
+	served chan struct{}
+	err    error
+
+	// connsLock protects conns and states, and is signalled by stateChanged
+	// whenever the server reports a connection state change.
+	// Connections are identified by their client's LocalAddr, which is the
+	// server's RemoteAddr.
+	connsLock    sync.Mutex
+	stateChanged *sync.Cond
+	conns        []*Conn
+	states       map[string]http.ConnState
+}
+
+// Start serves srv on a new graceful.PipeListener and returns once it is
+// serving. Signal handling is disabled, use Interrupt or Signal instead. If
+// srv has no Clock, a fake Clock is installed so that its timeouts only
+// elapse when the test advances it. The server is stopped when the test
+// ends.
+func Start(t testing.TB, srv *graceful.Server) *Harness {
+	t.Helper()
+
+	if srv.Server == nil {
+		srv.Server = &http.Server{}
+	}
+	if srv.Clock == nil {
+		srv.Clock = NewClock(time.Now())
+	}
+	srv.NoSignalHandling = true
+	srv.Handler = hijacker(srv.Handler)
+
+	h := &Harness{
+		Server:   srv,
+		Listener: graceful.NewPipeListener(),
+		t:        t,
+		served:   make(chan struct{}),
+		states:   map[string]http.ConnState{},
+	}
+	h.Clock, _ = srv.Clock.(*Clock)
+	h.stateChanged = sync.NewCond(&h.connsLock)
+
+	connState := srv.ConnState
+	srv.ConnState = func(conn net.Conn, state http.ConnState) {
+		h.connsLock.Lock()
+		h.states[conn.RemoteAddr().String()] = state
+		h.stateChanged.Broadcast()
+		h.connsLock.Unlock()
+
+		if connState != nil {
+			connState(conn, state)
+		}
+	}
+
+	serving := make(chan struct{})
+	unsubscribe := srv.Subscribe(func(tr graceful.Transition) {
+		if tr.To == graceful.StateServing {
+			close(serving)
+		}
+	})
+	go func() {
+		defer close(h.served)
+		h.err = srv.Serve(h.Listener)
+	}()
+	select {
+	case <-serving:
+	case <-h.served:
+	}
+	unsubscribe()
+
+	t.Cleanup(h.cleanup)
+	return h
+}
+
+// hijacker wraps handler so that requests to HijackPath hijack their
+// connection.
+func hijacker(handler http.Handler) http.Handler {
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != HijackPath {
+			handler.ServeHTTP(rw, r)
+			return
+		}
+
+		conn, bufrw, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		bufrw.WriteString("HTTP/1.1 101 Switching Protocols\r\n\r\n")
+		bufrw.Flush()
+
+		// Hold the connection until the client goes away.
+		go func() {
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}()
+	})
+}
+
+// cleanup closes the client connections and stops the server.
+func (h *Harness) cleanup() {
+	h.connsLock.Lock()
+	for _, c := range h.conns {
+		c.Close()
+	}
+	h.connsLock.Unlock()
+
+	h.Server.Stop(0)
+	select {
+	case <-h.served:
+	case <-time.After(5 * time.Second):
+		h.t.Error("gracefultest: server did not stop at the end of the test")
+	}
+}
+
+// Client returns an http.Client which connects to the server.
+func (h *Harness) Client() *http.Client {
+	return &http.Client{Transport: &http.Transport{DialContext: h.Listener.DialContext}}
+}
+
+// Dial opens a new client connection to the server, failing the test if the
+// server does not accept it. It returns once graceful tracks the connection.
+func (h *Harness) Dial() *Conn {
+	h.t.Helper()
+
+	nc, err := h.Listener.Dial()
+	if err != nil {
+		h.t.Fatalf("gracefultest: dial: %s", err)
+	}
+	c := &Conn{Conn: nc, r: bufio.NewReader(nc)}
+
+	h.connsLock.Lock()
+	h.conns = append(h.conns, c)
+	h.connsLock.Unlock()
+
+	h.waitState(c, http.StateNew)
+	return c
+}
+
+// waitState blocks until the server reports c in state.
+func (h *Harness) waitState(c *Conn, state http.ConnState) {
+	h.connsLock.Lock()
+	defer h.connsLock.Unlock()
+
+	for h.states[c.LocalAddr().String()] != state {
+		h.stateChanged.Wait()
+	}
+}
+
+// State returns the last state reported by the server for c.
+func (h *Harness) State(c *Conn) http.ConnState {
+	h.connsLock.Lock()
+	defer h.connsLock.Unlock()
+
+	return h.states[c.LocalAddr().String()]
+}
+
+// OpenIdle opens a connection on which no request is sent.
+func (h *Harness) OpenIdle() *Conn {
+	h.t.Helper()
+
+	return h.Dial()
+}
+
+// OpenKeepAlive opens a connection, completes a request to path on it and
+// leaves it open, idle, for further requests.
+func (h *Harness) OpenKeepAlive(path string) *Conn {
+	h.t.Helper()
+
+	c := h.Dial()
+	c.Send("GET", path)
+	resp, err := c.Response()
+	if err != nil {
+		h.t.Fatalf("gracefultest: keep-alive request: %s", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	h.waitState(c, http.StateIdle)
+	return c
+}
+
+// OpenSlow opens a connection and sends a request to path on it without
+// reading the response, so the connection stays active until the handler
+// returns and the response is read with Response.
+func (h *Harness) OpenSlow(path string) *Conn {
+	h.t.Helper()
+
+	c := h.Dial()
+	c.Send("GET", path)
+	h.waitState(c, http.StateActive)
+	return c
+}
+
+// OpenHijacked opens a connection which the server hijacks, and which is
+// thus no longer tracked by graceful.
+func (h *Harness) OpenHijacked() *Conn {
+	h.t.Helper()
+
+	c := h.Dial()
+	c.Send("GET", HijackPath)
+	resp, err := c.Response()
+	if err != nil {
+		h.t.Fatalf("gracefultest: hijack request: %s", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		h.t.Fatalf("gracefultest: hijack request: unexpected status %s", resp.Status)
+	}
+	h.waitState(c, http.StateHijacked)
+	return c
+}
+
+// Interrupt delivers os.Interrupt to the server, as if the process had
+// received SIGINT.
+func (h *Harness) Interrupt() {
+	h.Signal(os.Interrupt)
+}
+
+// Signal delivers sig to the server without involving the operating system.
+func (h *Harness) Signal(sig os.Signal) {
+	h.Server.Signal(sig)
+}
+
+// Wait blocks until Serve returns and returns its error.
+func (h *Harness) Wait() error {
+	<-h.served
+	return h.err
+}
+
+// Stopped reports whether Serve has returned.
+func (h *Harness) Stopped() bool {
+	select {
+	case <-h.served:
+		return true
+	default:
+		return false
+	}
+}
+
+// Report waits for the server to stop and returns its shutdown report.
+func (h *Harness) Report() graceful.ShutdownReport {
+	h.Wait()
+	return h.Server.ShutdownReport()
+}
+
+// AssertStages fails the test unless the shutdown went through exactly the
+// given stages.
+func (h *Harness) AssertStages(stages ...graceful.ShutdownStage) {
+	h.t.Helper()
+
+	if actual := h.Report().Stages; !reflect.DeepEqual(actual, stages) {
+		h.t.Errorf("gracefultest: shutdown stages are %v, expected %v", actual, stages)
+	}
+}
+
+// AssertConnections fails the test unless n connections were open when the
+// shutdown began.
+func (h *Harness) AssertConnections(n int) {
+	h.t.Helper()
+
+	h.assertCount("open connections", h.Report().Connections, n)
+}
+
+// AssertIdleClosed fails the test unless n idle connections were closed
+// during the shutdown.
+func (h *Harness) AssertIdleClosed(n int) {
+	h.t.Helper()
+
+	h.assertCount("idle connections closed", h.Report().IdleClosed, n)
+}
+
+// AssertKilled fails the test unless n connections were forcefully closed.
+func (h *Harness) AssertKilled(n int) {
+	h.t.Helper()
+
+	h.assertCount("connections killed", h.Report().Killed, n)
+}
+
+func (h *Harness) assertCount(what string, actual, expected int) {
+	h.t.Helper()
+
+	if actual != expected {
+		h.t.Errorf("gracefultest: %s: %d, expected %d", what, actual, expected)
+	}
+}
+
+// Conn is a client connection to a server run by a Harness.
+type Conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// Send writes a request for path on the connection.
+func (c *Conn) Send(method, path string) error {
+	_, err := fmt.Fprintf(c, "%s %s HTTP/1.1\r\nHost: gracefultest\r\n\r\n", method, path)
+	return err
+}
+
+// SendPartial writes the request line for path without completing the
+// headers, like a slow client would.
+func (c *Conn) SendPartial(method, path string) error {
+	_, err := fmt.Fprintf(c, "%s %s HTTP/1.1\r\n", method, path)
+	return err
+}
+
+// Response reads the next response from the connection.
+func (c *Conn) Response() (*http.Response, error) {
+	return http.ReadResponse(c.r, nil)
+}
+
+// WaitClosed blocks until the server closes the connection or d elapses, and
+// reports whether the connection was closed. Data sent by the server in the
+// meantime is discarded.
+func (c *Conn) WaitClosed(d time.Duration) bool {
+	c.SetReadDeadline(time.Now().Add(d))
+	defer c.SetReadDeadline(time.Time{})
+
+	for {
+		if _, err := c.r.ReadByte(); err != nil {
+			ne, ok := err.(net.Error)
+			return !ok || !ne.Timeout()
+		}
+	}
+}
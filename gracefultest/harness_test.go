@@ -0,0 +1,76 @@
+package gracefultest
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1"
+)
+
+func TestHarnessClosesIdleConnections(t *testing.T) {
+	h := Start(t, &graceful.Server{
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		})},
+	})
+
+	resp, err := h.Client().Get("http://gracefultest/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	idle := h.OpenIdle()
+	keepAlive := h.OpenKeepAlive("/")
+	hijacked := h.OpenHijacked()
+
+	h.Interrupt()
+	if err := h.Wait(); err != nil {
+		t.Fatalf("Serve returned %s", err)
+	}
+
+	if !idle.WaitClosed(time.Second) {
+		t.Error("idle connection should have been closed")
+	}
+	if !keepAlive.WaitClosed(time.Second) {
+		t.Error("keep-alive connection should have been closed")
+	}
+	if hijacked.WaitClosed(10 * time.Millisecond) {
+		t.Error("hijacked connection should have been left open")
+	}
+
+	h.AssertKilled(0)
+	h.AssertStages(graceful.StageDrain)
+}
+
+func TestHarnessKillsSlowRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	h := Start(t, &graceful.Server{
+		Timeout: time.Minute,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		})},
+	})
+
+	slow := h.OpenSlow("/")
+	<-started
+
+	h.Interrupt()
+	h.Clock.BlockUntil(1)
+	if h.Stopped() {
+		t.Fatal("server stopped before the timeout elapsed")
+	}
+	h.Clock.Advance(time.Minute)
+
+	if !slow.WaitClosed(time.Second) {
+		t.Error("slow connection should have been killed")
+	}
+	h.AssertConnections(1)
+	h.AssertKilled(1)
+	h.AssertStages(graceful.StageDrain, graceful.StageKill)
+}
@@ -25,10 +25,7 @@ func createServer() *http.Server {
 	return server
 }
 
-func checkIfConnectionToServerIsHTTP2(t *testing.T, wg *sync.WaitGroup, c chan os.Signal) {
-
-	defer wg.Done()
-
+func checkIfConnectionToServerIsHTTP2(c chan os.Signal) error {
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
@@ -36,7 +33,7 @@ func checkIfConnectionToServerIsHTTP2(t *testing.T, wg *sync.WaitGroup, c chan o
 	err := http2.ConfigureTransport(tr)
 
 	if err != nil {
-		t.Fatal("Unable to upgrade client transport to HTTP/2")
+		return fmt.Errorf("Unable to upgrade client transport to HTTP/2")
 	}
 
 	client := http.Client{Transport: tr}
@@ -45,12 +42,13 @@ func checkIfConnectionToServerIsHTTP2(t *testing.T, wg *sync.WaitGroup, c chan o
 	c <- os.Interrupt
 
 	if err != nil {
-		t.Fatalf("Error encountered while connecting to test server: %s", err)
+		return fmt.Errorf("Error encountered while connecting to test server: %s", err)
 	}
 
 	if !r.ProtoAtLeast(2, 0) {
-		t.Fatalf("Expected HTTP/2 connection to server, but connection was using %s", r.Proto)
+		return fmt.Errorf("Expected HTTP/2 connection to server, but connection was using %s", r.Proto)
 	}
+	return nil
 }
 
 func TestHTTP2ListenAndServeTLS(t *testing.T) {
@@ -72,8 +70,9 @@ func TestHTTP2ListenAndServeTLS(t *testing.T) {
 
 	time.Sleep(waitTime) // Wait for the server to start
 
-	wg.Add(1)
-	go checkIfConnectionToServerIsHTTP2(t, &wg, c)
+	if err := checkIfConnectionToServerIsHTTP2(c); err != nil {
+		t.Fatal(err)
+	}
 	wg.Wait()
 
 	c <- os.Interrupt // kill the server to close idle connections
@@ -97,29 +96,29 @@ func TestHTTP2ListenAndServeTLSConfig(t *testing.T) {
 
 	server2 := createServer()
 
-	go func() {
-		srv := &Server{Timeout: killTime, TCPKeepAlive: 1 * time.Minute, Server: server2, interrupt: c}
-
-		cert, err := tls.LoadX509KeyPair("test-fixtures/cert.crt", "test-fixtures/key.pem")
+	cert, err := tls.LoadX509KeyPair("test-fixtures/cert.crt", "test-fixtures/key.pem")
 
-		if err != nil {
-			t.Fatalf("Unexpected error: %s", err)
-		}
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
 
-		tlsConf := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			NextProtos:   []string{"h2"}, // We need to explicitly enable http/2 in Go 1.7+
-		}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"}, // We need to explicitly enable http/2 in Go 1.7+
+	}
 
-		tlsConf.BuildNameToCertificate()
+	tlsConf.BuildNameToCertificate()
 
+	go func() {
+		srv := &Server{Timeout: killTime, TCPKeepAlive: 1 * time.Minute, Server: server2, interrupt: c}
 		srv.ListenAndServeTLSConfig(tlsConf)
 		wg.Done()
 	}()
 
 	time.Sleep(waitTime) // Wait for the server to start
 
-	wg.Add(1)
-	go checkIfConnectionToServerIsHTTP2(t, &wg, c)
+	if err := checkIfConnectionToServerIsHTTP2(c); err != nil {
+		t.Fatal(err)
+	}
 	wg.Wait()
 }
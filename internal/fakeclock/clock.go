@@ -0,0 +1,92 @@
+// Package fakeclock provides a fake graceful.Clock, for the tests of
+// graceful and for the gracefultest package, which exports it.
+package fakeclock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a fake graceful.Clock whose time only moves when Advance is
+// called.
+type Clock struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []waiter
+}
+
+// waiter is a pending call to After.
+type waiter struct {
+	until time.Time
+	c     chan time.Time
+}
+
+// New returns a fake Clock set to now.
+func New(now time.Time) *Clock {
+	c := &Clock{now: now}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+// Now returns the current fake time.
+func (c *Clock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// After returns a channel on which the fake time is sent once the clock has
+// been advanced by at least d.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, waiter{until: c.now.Add(d), c: ch})
+	c.cond.Broadcast()
+	return ch
+}
+
+// Advance moves the fake time forward by d, firing every timer which
+// expires on the way.
+func (c *Clock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.until.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- c.now
+	}
+	c.waiters = pending
+}
+
+// Waiters returns the number of timers which have not fired yet.
+func (c *Clock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.waiters)
+}
+
+// BlockUntil blocks until at least n timers are waiting on the clock. It is
+// used to make sure the code under test has started a timer before the
+// clock is advanced.
+func (c *Clock) BlockUntil(n int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
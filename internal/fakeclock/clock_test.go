@@ -0,0 +1,42 @@
+package fakeclock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockAdvance(t *testing.T) {
+	start := time.Now()
+	clock := New(start)
+
+	short := clock.After(time.Second)
+	long := clock.After(time.Minute)
+	if n := clock.Waiters(); n != 2 {
+		t.Fatalf("expected 2 waiters, got %d", n)
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case now := <-short:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("timer fired at %s, expected %s", now, start.Add(time.Second))
+		}
+	default:
+		t.Fatal("timer should have fired")
+	}
+	select {
+	case <-long:
+		t.Fatal("timer should not have fired")
+	default:
+	}
+
+	clock.Advance(time.Hour)
+	select {
+	case <-long:
+	default:
+		t.Fatal("timer should have fired")
+	}
+	if n := clock.Waiters(); n != 0 {
+		t.Fatalf("expected no waiters, got %d", n)
+	}
+}
@@ -0,0 +1,179 @@
+package graceful
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lifecycle holds the shutdown options and methods StreamServer, Runner and
+// PacketServer share with Server. It is embedded in each of them, and is
+// not meant to be used on its own.
+//
+// Each option behaves as the Server field of the same name, with the
+// server's connections, Drainable or packet connection standing for the
+// connections of an http.Server.
+type Lifecycle struct {
+	// Timeout is the duration to allow the server to drain before
+	// forcefully stopping it.
+	Timeout time.Duration
+
+	// Clock is the source of time for the shutdown timers. If nil, the
+	// system clock is used.
+	Clock Clock
+
+	// ShutdownPolicy, StageReached, ShutdownDelay, ShutdownDelayFunc and
+	// ShutdownBudget shape the shutdown.
+	ShutdownPolicy    *ShutdownPolicy
+	StageReached      func(ShutdownStage)
+	ShutdownDelay     time.Duration
+	ShutdownDelayFunc func(ctx context.Context) error
+	ShutdownBudget    time.Duration
+
+	// OnListen, Registrar, RegisterAttempts and RegisterTimeout announce
+	// the server once it is bound.
+	OnListen         func(addrs []net.Addr)
+	Registrar        Registrar
+	RegisterAttempts int
+	RegisterTimeout  time.Duration
+
+	// BeforeShutdown and ShutdownInitiated are called when shutdown is
+	// initiated.
+	BeforeShutdown    func() bool
+	ShutdownInitiated func()
+
+	// NoSignalHandling, Signals, Reload, SignalFunc and
+	// IgnoreRepeatedSignals configure signal handling.
+	NoSignalHandling      bool
+	Signals               map[os.Signal]SignalAction
+	Reload                func()
+	SignalFunc            func(os.Signal)
+	IgnoreRepeatedSignals bool
+
+	// Logger, LogFunc, StructuredLogger and Tracer report what the server
+	// does.
+	Logger           *log.Logger
+	LogFunc          func(format string, args ...interface{})
+	StructuredLogger StructuredLogger
+	Tracer           Tracer
+
+	// srv is the Server managing the lifecycle.
+	srv     *Server
+	srvOnce sync.Once
+}
+
+// server returns the Server managing the lifecycle.
+func (l *Lifecycle) server() *Server {
+	l.srvOnce.Do(func() { l.srv = &Server{} })
+	return l.srv
+}
+
+// configure returns the Server managing the lifecycle, set up with the
+// options of l and served by the engine returned by newEngine. It fails
+// with ErrServerRunning if the server is running.
+func (l *Lifecycle) configure(newEngine func(srv *Server) engine) (*Server, error) {
+	srv := l.server()
+	if srv.State().running() {
+		return nil, ErrServerRunning
+	}
+	if srv.engine == nil {
+		srv.engine = newEngine(srv)
+	}
+
+	srv.Timeout = l.Timeout
+	srv.Clock = l.Clock
+	srv.ShutdownPolicy = l.ShutdownPolicy
+	srv.StageReached = l.StageReached
+	srv.ShutdownDelay = l.ShutdownDelay
+	srv.ShutdownDelayFunc = l.ShutdownDelayFunc
+	srv.ShutdownBudget = l.ShutdownBudget
+	srv.OnListen = l.OnListen
+	srv.Registrar = l.Registrar
+	srv.RegisterAttempts = l.RegisterAttempts
+	srv.RegisterTimeout = l.RegisterTimeout
+	srv.BeforeShutdown = l.BeforeShutdown
+	srv.ShutdownInitiated = l.ShutdownInitiated
+	srv.NoSignalHandling = l.NoSignalHandling
+	srv.Signals = l.Signals
+	srv.Reload = l.Reload
+	srv.SignalFunc = l.SignalFunc
+	srv.IgnoreRepeatedSignals = l.IgnoreRepeatedSignals
+	srv.Logger = l.Logger
+	srv.LogFunc = l.LogFunc
+	srv.StructuredLogger = l.StructuredLogger
+	srv.Tracer = l.Tracer
+	return srv, nil
+}
+
+// Stop initiates the shutdown of the server, forcefully stopping it once
+// timeout has elapsed. See Server.Stop.
+func (l *Lifecycle) Stop(timeout time.Duration) {
+	l.server().Stop(timeout)
+}
+
+// Drain initiates the shutdown of the server with its Timeout, as if it
+// had been interrupted. See Server.Drain.
+func (l *Lifecycle) Drain() {
+	l.server().Drain()
+}
+
+// StopChan gets the stop channel which will block until stopping has
+// completed, at which point it is closed.
+func (l *Lifecycle) StopChan() <-chan struct{} {
+	return l.server().StopChan()
+}
+
+// Signal delivers sig to the server as if it had been received from the
+// operating system.
+func (l *Lifecycle) Signal(sig os.Signal) {
+	l.server().Signal(sig)
+}
+
+// Ready returns a channel which is closed once the server is serving.
+func (l *Lifecycle) Ready() <-chan struct{} {
+	return l.server().Ready()
+}
+
+// Failed returns a channel which is closed if the server fails to start
+// serving, after which StartErr returns the error.
+func (l *Lifecycle) Failed() <-chan struct{} {
+	return l.server().Failed()
+}
+
+// StartErr returns the error which prevented the server from serving, or
+// nil.
+func (l *Lifecycle) StartErr() error {
+	return l.server().StartErr()
+}
+
+// Addrs returns the addresses the server listens on, or nil if it is not
+// serving.
+func (l *Lifecycle) Addrs() []net.Addr {
+	return l.server().Addrs()
+}
+
+// State returns the current state of the server.
+func (l *Lifecycle) State() State {
+	return l.server().State()
+}
+
+// Subscribe registers fn to be called on each state transition of the
+// server. See Server.Subscribe.
+func (l *Lifecycle) Subscribe(fn func(Transition)) (unsubscribe func()) {
+	return l.server().Subscribe(fn)
+}
+
+// Events returns a channel on which the lifecycle events of the server are
+// sent. See Server.Events.
+func (l *Lifecycle) Events(buffer int) (events <-chan Event, unsubscribe func()) {
+	return l.server().Events(buffer)
+}
+
+// ShutdownReport returns the report of the last completed shutdown of the
+// server.
+func (l *Lifecycle) ShutdownReport() ShutdownReport {
+	return l.server().ShutdownReport()
+}
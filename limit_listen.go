@@ -27,19 +27,38 @@ var ErrNotTCP = errors.New("only tcp connections have keepalive")
 // LimitListener returns a Listener that accepts at most n simultaneous
 // connections from the provided Listener.
 func LimitListener(l net.Listener, n int) net.Listener {
-	return &limitListener{l, make(chan struct{}, n)}
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+	}
 }
 
 type limitListener struct {
 	net.Listener
-	sem chan struct{}
+	sem       chan struct{}
+	closeOnce sync.Once
+	done      chan struct{} // closed when the listener is closed
 }
 
-func (l *limitListener) acquire() { l.sem <- struct{}{} }
+// acquire waits for a free slot, and reports false if the listener was
+// closed in the meantime.
+func (l *limitListener) acquire() bool {
+	select {
+	case <-l.done:
+		return false
+	case l.sem <- struct{}{}:
+		return true
+	}
+}
 func (l *limitListener) release() { <-l.sem }
 
 func (l *limitListener) Accept() (net.Conn, error) {
-	l.acquire()
+	if !l.acquire() {
+		// Without this, Accept would block until a connection is released,
+		// even though the listener is closed.
+		return nil, &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: net.ErrClosed}
+	}
 	c, err := l.Listener.Accept()
 	if err != nil {
 		l.release()
@@ -48,6 +67,12 @@ func (l *limitListener) Accept() (net.Conn, error) {
 	return &limitListenerConn{Conn: c, release: l.release}, nil
 }
 
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
 type limitListenerConn struct {
 	net.Conn
 	releaseOnce sync.Once
@@ -61,17 +86,17 @@ func (l *limitListenerConn) Close() error {
 }
 
 func (l *limitListenerConn) SetKeepAlive(doKeepAlive bool) error {
-	tcpc, ok := l.Conn.(*net.TCPConn)
+	kac, ok := l.Conn.(keepAliveConn)
 	if !ok {
 		return ErrNotTCP
 	}
-	return tcpc.SetKeepAlive(doKeepAlive)
+	return kac.SetKeepAlive(doKeepAlive)
 }
 
 func (l *limitListenerConn) SetKeepAlivePeriod(d time.Duration) error {
-	tcpc, ok := l.Conn.(*net.TCPConn)
+	kac, ok := l.Conn.(keepAliveConn)
 	if !ok {
 		return ErrNotTCP
 	}
-	return tcpc.SetKeepAlivePeriod(d)
+	return kac.SetKeepAlivePeriod(d)
 }
@@ -0,0 +1,111 @@
+package graceful
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// Level is the severity of a log event. Its values match those of
+// slog.Level.
+type Level int
+
+const (
+	// LevelDebug is for routine events, such as the server listening or
+	// idle connections being closed.
+	LevelDebug Level = -4
+
+	// LevelInfo is for lifecycle changes, such as a shutdown being
+	// initiated.
+	LevelInfo Level = 0
+
+	// LevelWarn is for events which may lose work, such as connections
+	// being forcefully closed.
+	LevelWarn Level = 4
+
+	// LevelError is for failures, such as a connection failing to close.
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// StructuredLogger receives the log events of a server. keyvals alternate
+// between keys, which are strings, and their values.
+type StructuredLogger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// SlogLogger returns a StructuredLogger writing to l.
+func SlogLogger(l *slog.Logger) StructuredLogger {
+	return slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (l slogLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	l.l.Log(context.Background(), slog.Level(level), msg, keyvals...)
+}
+
+// PrintfLogger returns a StructuredLogger writing events at LevelInfo and
+// above to a printf-style function, such as log.Printf, in the format used
+// for Logger and LogFunc:
+//
+//	[WARN] connections killed count=2
+func PrintfLogger(printf func(format string, args ...interface{})) StructuredLogger {
+	return printfLogger(printf)
+}
+
+type printfLogger func(format string, args ...interface{})
+
+func (l printfLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < LevelInfo {
+		return
+	}
+	var b strings.Builder
+	if level > LevelInfo {
+		fmt.Fprintf(&b, "[%s] ", level)
+	}
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keyvals[i])
+		}
+	}
+	l("%s", b.String())
+}
+
+// logger returns the logger of the server, or nil if it does not log.
+func (srv *Server) logger() StructuredLogger {
+	switch {
+	case srv.StructuredLogger != nil:
+		return srv.StructuredLogger
+	case srv.LogFunc != nil:
+		return printfLogger(srv.LogFunc)
+	case srv.Logger != nil:
+		return printfLogger(srv.Logger.Printf)
+	}
+	return nil
+}
+
+func (srv *Server) log(level Level, msg string, keyvals ...interface{}) {
+	if l := srv.logger(); l != nil {
+		l.Log(level, msg, keyvals...)
+	}
+}
@@ -0,0 +1,132 @@
+package graceful
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+type logEvent struct {
+	level   Level
+	msg     string
+	keyvals []interface{}
+}
+
+// recordingLogger is a StructuredLogger keeping every event.
+type recordingLogger struct {
+	mu     sync.Mutex
+	events []logEvent
+}
+
+func (l *recordingLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, logEvent{level, msg, keyvals})
+}
+
+func (l *recordingLogger) find(msg string) (logEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, e := range l.events {
+		if e.msg == msg {
+			return e, true
+		}
+	}
+	return logEvent{}, false
+}
+
+func TestStructuredLogger(t *testing.T) {
+	pl := NewPipeListener()
+	logger := &recordingLogger{}
+	var printed []string
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Timeout:          time.Minute,
+		Clock:            clock,
+		NoSignalHandling: true,
+		StructuredLogger: logger,
+		LogFunc: func(format string, args ...interface{}) {
+			printed = append(printed, fmt.Sprintf(format, args...))
+		},
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	// A request keeps its connection active until it is killed.
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	srv.Stop(time.Minute)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-srv.StopChan()
+
+	expected := []logEvent{
+		{LevelDebug, "listening", nil},
+		{LevelInfo, "shutdown initiated", nil},
+		{LevelWarn, "connections killed", []interface{}{"count", 1}},
+	}
+	for _, want := range expected {
+		got, ok := logger.find(want.msg)
+		if !ok {
+			t.Errorf("expected %q to be logged", want.msg)
+			continue
+		}
+		if got.level != want.level {
+			t.Errorf("expected %q to be logged at %s, got %s", want.msg, want.level, got.level)
+		}
+		if want.keyvals != nil && fmt.Sprint(got.keyvals) != fmt.Sprint(want.keyvals) {
+			t.Errorf("expected %q to be logged with %v, got %v", want.msg, want.keyvals, got.keyvals)
+		}
+	}
+	if len(printed) != 0 {
+		t.Errorf("expected StructuredLogger to take precedence over LogFunc, got %q", printed)
+	}
+}
+
+func TestPrintfLogger(t *testing.T) {
+	var lines []string
+	l := PrintfLogger(func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+	l.Log(LevelDebug, "listening", "addrs", "[:80]")
+	l.Log(LevelInfo, "shutdown initiated")
+	l.Log(LevelError, "close failed", "remote", "1.2.3.4:5", "error", "broken pipe")
+
+	expected := []string{
+		"shutdown initiated",
+		"[ERROR] close failed remote=1.2.3.4:5 error=broken pipe",
+	}
+	if fmt.Sprint(lines) != fmt.Sprint(expected) {
+		t.Fatalf("Incorrect log lines.\n  actual: %q\nexpected: %q\n", lines, expected)
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := SlogLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	l.Log(LevelWarn, "connections killed", "count", 2)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record["level"] != "WARN" || record["msg"] != "connections killed" || record["count"] != 2.0 {
+		t.Fatalf("unexpected slog record %v", record)
+	}
+}
@@ -0,0 +1,228 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// PacketServer serves a packet protocol, such as DNS or syslog over UDP,
+// with the same signal handling and shutdown timeout as Server.
+//
+// Packets are read into a queue and handled by a pool of workers. When the
+// server starts draining, it stops reading packets but finishes handling
+// the queued ones. If they are still being handled when Timeout elapses,
+// the handlers' contexts are cancelled and the connection is closed. In the
+// ShutdownReport, the packet connection counts as a single connection,
+// which is killed if its handlers had to be cancelled.
+//
+// Example:
+//
+//	srv := &graceful.PacketServer{
+//		Addr:      ":5353",
+//		Lifecycle: graceful.Lifecycle{Timeout: 5 * time.Second},
+//		Handler: func(ctx context.Context, conn net.PacketConn, packet []byte, addr net.Addr) {
+//			conn.WriteTo(answer(packet), addr)
+//		},
+//	}
+//	srv.ListenAndServe()
+type PacketServer struct {
+	// Addr is the UDP address to listen on by ListenAndServe.
+	Addr string
+
+	// Handler handles a packet received from addr. It may reply through
+	// conn. packet is only valid until the handler returns.
+	Handler func(ctx context.Context, conn net.PacketConn, packet []byte, addr net.Addr)
+
+	// Workers is the number of packets handled concurrently. If zero,
+	// GOMAXPROCS is used.
+	Workers int
+
+	// QueueSize is the number of packets read ahead of the workers. If
+	// zero, it is the number of workers.
+	QueueSize int
+
+	// MaxPacketSize is the size of the buffer packets are read into. If
+	// zero, 65535 bytes are used, which fits any UDP packet.
+	MaxPacketSize int
+
+	// Lifecycle's Timeout is the duration to allow queued packets to be
+	// handled before cancelling their handlers, and BeforeShutdown is
+	// called before the server stops reading packets.
+	Lifecycle
+}
+
+// ListenAndServe listens on the UDP address Addr and serves packets with
+// graceful shutdown enabled.
+func (s *PacketServer) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return s.server().startFailed(err)
+	}
+	return s.Serve(conn)
+}
+
+// Serve handles the packets received on conn with graceful shutdown
+// enabled. conn is closed once Serve returns.
+func (s *PacketServer) Serve(conn net.PacketConn) error {
+	srv, err := s.configure(func(srv *Server) engine {
+		return &packetEngine{srv: srv, packetSrv: s}
+	})
+	if err != nil {
+		return err
+	}
+	return srv.Serve(&packetListener{PacketConn: conn, done: make(chan struct{})})
+}
+
+func (s *PacketServer) workers() int {
+	if s.Workers > 0 {
+		return s.Workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+func (s *PacketServer) maxPacketSize() int {
+	if s.MaxPacketSize > 0 {
+		return s.MaxPacketSize
+	}
+	return 65535
+}
+
+// packetListener lets a PacketServer be served by Server. It never accepts
+// connections, and closing it stops reads on the packet connection while
+// leaving it open for replies.
+type packetListener struct {
+	net.PacketConn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var errPacketListener = errors.New("graceful: packet connections do not accept connections")
+
+func (l *packetListener) Accept() (net.Conn, error) {
+	<-l.done
+	return nil, errPacketListener
+}
+
+func (l *packetListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		// unblock pending reads.
+		err = l.SetReadDeadline(time.Unix(1, 0))
+	})
+	return err
+}
+
+func (l *packetListener) Addr() net.Addr {
+	return l.LocalAddr()
+}
+
+// packet is a packet waiting to be handled.
+type packet struct {
+	buf  *[]byte
+	n    int
+	addr net.Addr
+}
+
+// packetEngine reads packets into a queue handled by a pool of workers.
+// The packet connection is tracked as a single connection, which is active
+// until every queued packet has been handled.
+type packetEngine struct {
+	srv       *Server
+	packetSrv *PacketServer
+
+	// ctx is passed to the handlers of the current run, and cancelled
+	// when the server is killed.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (e *packetEngine) hook() {
+	e.ctx, e.cancel = context.WithCancel(e.srv.run.Load().(*run).ctx)
+}
+
+// setDraining does nothing, as reads stop when the listener is closed.
+func (e *packetEngine) setDraining(draining bool) {}
+
+func (e *packetEngine) serve(l net.Listener) error {
+	pl := l.(*pauseListener).Listener.(*packetListener)
+	pc := pl.PacketConn
+	cancel := e.cancel
+	conn := &serverConn{
+		addr: pc.LocalAddr(),
+		stop: func() {
+			cancel()
+			pc.Close()
+		},
+	}
+	e.srv.connState(conn, http.StateNew)
+	e.srv.connState(conn, http.StateActive)
+
+	size := e.packetSrv.maxPacketSize()
+	bufs := sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}}
+	queueSize := e.packetSrv.QueueSize
+	if queueSize <= 0 {
+		queueSize = e.packetSrv.workers()
+	}
+	queue := make(chan packet, queueSize)
+
+	var wg sync.WaitGroup
+	for i := 0; i < e.packetSrv.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range queue {
+				e.packetSrv.Handler(e.ctx, pc, (*p.buf)[:p.n], p.addr)
+				bufs.Put(p.buf)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		pc.Close()
+		conn.release(e.srv)
+	}()
+	defer close(queue)
+
+	var delay time.Duration
+	for {
+		buf := bufs.Get().(*[]byte)
+		n, addr, err := pc.ReadFrom(*buf)
+		if (n > 0 || err == nil) && e.srv.State() != StatePaused {
+			queue <- packet{buf: buf, n: n, addr: addr}
+		} else {
+			// packets received while paused are dropped.
+			bufs.Put(buf)
+		}
+		if err == nil {
+			delay = 0
+			continue
+		}
+
+		select {
+		case <-pl.done:
+			return err
+		default:
+		}
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			// Back off like http.Server does.
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			e.srv.log(LevelError, "read failed, retrying", "retry_in", delay, "error", err)
+			time.Sleep(delay)
+			continue
+		}
+		return err
+	}
+}
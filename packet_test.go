@@ -0,0 +1,117 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+func listenUDP(t *testing.T) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func sendPackets(t *testing.T, addr net.Addr, packets ...string) {
+	conn, err := net.Dial("udp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, p := range packets {
+		if _, err := conn.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPacketServerDrainsQueue(t *testing.T) {
+	pc := listenUDP(t)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var handled []string
+	srv := &PacketServer{
+		Workers:   1,
+		QueueSize: 4,
+		Lifecycle: Lifecycle{Timeout: timeoutTime, NoSignalHandling: true},
+		Handler: func(ctx context.Context, conn net.PacketConn, packet []byte, addr net.Addr) {
+			<-release
+			mu.Lock()
+			handled = append(handled, string(packet))
+			mu.Unlock()
+		},
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(pc) }()
+
+	// The first packet blocks the only worker, the others are queued.
+	sendPackets(t, pc.LocalAddr(), "1", "2", "3")
+	time.Sleep(waitTime)
+
+	srv.Stop(timeoutTime)
+	time.Sleep(waitTime)
+	sendPackets(t, pc.LocalAddr(), "too late")
+	close(release)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to drain")
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("Serve returned %s", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handled) != 3 || handled[0] != "1" || handled[1] != "2" || handled[2] != "3" {
+		t.Fatalf("expected the queued packets to be handled, got %q", handled)
+	}
+	if report := srv.ShutdownReport(); report.Killed != 0 {
+		t.Fatalf("unexpected shutdown report %+v", report)
+	}
+}
+
+func TestPacketServerCancelsAtTimeout(t *testing.T) {
+	pc := listenUDP(t)
+	cancelled := make(chan struct{})
+	clock := fakeclock.New(time.Now())
+	srv := &PacketServer{
+		Lifecycle: Lifecycle{Timeout: time.Minute, Clock: clock, NoSignalHandling: true},
+		Handler: func(ctx context.Context, conn net.PacketConn, packet []byte, addr net.Addr) {
+			<-ctx.Done()
+			close(cancelled)
+		},
+	}
+	go srv.Serve(pc)
+
+	sendPackets(t, pc.LocalAddr(), "hang")
+	time.Sleep(waitTime)
+
+	srv.Stop(time.Minute)
+	clock.BlockUntil(1)
+	select {
+	case <-srv.StopChan():
+		t.Fatal("server stopped before its timeout")
+	default:
+	}
+	clock.Advance(time.Minute)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to be killed")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(timeoutTime):
+		t.Fatal("expected the handler's context to be cancelled")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 1 {
+		t.Fatalf("expected the packet connection to be killed, got %+v", report)
+	}
+}
@@ -0,0 +1,48 @@
+package graceful
+
+import "net"
+
+// Pause makes the server reject new connections, while connections which
+// are already open are still served. It gives BeforeShutdown a chance to
+// veto the pause, as it is the first step of a shutdown: a paused server is
+// either resumed with Resume, or drained by Stop, Drain or a signal, in
+// which case BeforeShutdown is not called again.
+func (srv *Server) Pause() error {
+	if srv.State() != StateServing {
+		return ErrNotServing
+	}
+	if srv.BeforeShutdown != nil && !srv.BeforeShutdown() {
+		return ErrShutdownVetoed
+	}
+	if !srv.transition(StatePaused, StateServing) {
+		return ErrNotServing
+	}
+	srv.log(LevelInfo, "paused")
+	return nil
+}
+
+// Resume makes a paused server accept new connections again.
+func (srv *Server) Resume() error {
+	if !srv.transition(StateServing, StatePaused) {
+		return ErrNotPaused
+	}
+	srv.log(LevelInfo, "resumed")
+	return nil
+}
+
+// pauseListener closes the connections it accepts while the server is
+// paused, so that clients are turned away rather than left waiting.
+type pauseListener struct {
+	net.Listener
+	srv *Server
+}
+
+func (l *pauseListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || l.srv.State() != StatePaused {
+			return c, err
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// PipeListener is an in-memory net.Listener whose connections are created
+// with net.Pipe. It lets a Server be exercised by in-process clients, such
+// as tests, without binding a port.
+//
+// Example:
+//
+//	l := graceful.NewPipeListener()
+//	go srv.Serve(l)
+//	client := &http.Client{Transport: &http.Transport{DialContext: l.DialContext}}
+//	resp, err := client.Get("http://pipe/")
+type PipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	dialed    uint64
+}
+
+// NewPipeListener returns a new PipeListener.
+func NewPipeListener() *PipeListener {
+	return &PipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection dialed to the listener.
+func (l *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+// Close closes the listener. Connections already accepted are not closed.
+func (l *PipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr returns the listener's address.
+func (l *PipeListener) Addr() net.Addr {
+	return pipeAddr("pipe")
+}
+
+// Dial connects to the listener, blocking until the connection is accepted.
+func (l *PipeListener) Dial() (net.Conn, error) {
+	return l.DialContext(context.Background(), "pipe", "")
+}
+
+// DialContext connects to the listener, ignoring network and addr, and
+// blocks until the connection is accepted or ctx is done. It may be used as
+// the DialContext of an http.Transport.
+//
+// Each connection is given a unique address, which is the client's
+// LocalAddr and the server's RemoteAddr.
+func (l *PipeListener) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	id := pipeAddr("pipe:" + strconv.FormatUint(atomic.AddUint64(&l.dialed, 1), 10))
+	client, server := net.Pipe()
+	client = &pipeConn{Conn: client, local: id, remote: l.Addr()}
+	server = &pipeConn{Conn: server, local: l.Addr(), remote: id}
+
+	var err error
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		err = &net.OpError{Op: "dial", Net: "pipe", Addr: l.Addr(), Err: net.ErrClosed}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, err
+}
+
+// pipeConn is one end of a connection made through a PipeListener.
+type pipeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+// pipeAddr is the address of a PipeListener or of one of its connections.
+type pipeAddr string
+
+func (pipeAddr) Network() string  { return "pipe" }
+func (a pipeAddr) String() string { return string(a) }
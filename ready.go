@@ -0,0 +1,111 @@
+package graceful
+
+import "net"
+
+// Ready returns a channel which is closed once the server listens and is
+// serving. A new channel is returned once a stopped server is served
+// again. Ready stays closed while the server is paused or draining; see
+// State for the current state. It is never closed if the server fails to
+// start, so callers should also wait on Failed:
+//
+//	go srv.ListenAndServe()
+//	select {
+//	case <-srv.Ready():
+//	case <-srv.Failed():
+//		return srv.StartErr()
+//	}
+func (srv *Server) Ready() <-chan struct{} {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.readyChan == nil {
+		srv.readyChan = make(chan struct{})
+	}
+	return srv.readyChan
+}
+
+// Failed returns a channel which is closed if the server fails to start
+// serving, because it cannot listen or because its Registrar fails to
+// register it, after which StartErr returns the error. The stop channel is
+// closed as well. A new channel is returned once the server is served
+// again. A Serve returning ErrServerRunning does not close it, as the
+// server which is already running is unaffected.
+func (srv *Server) Failed() <-chan struct{} {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	if srv.failedChan == nil {
+		srv.failedChan = make(chan struct{})
+	}
+	return srv.failedChan
+}
+
+// StartErr returns the error which prevented the server from serving once
+// Failed is closed, or nil.
+func (srv *Server) StartErr() error {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	return srv.startErr
+}
+
+// startFailed records that the server failed to start with err, and
+// returns err. A server which never served is not stopped by Serve, so its
+// stop channel is closed here.
+func (srv *Server) startFailed(err error) error {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	srv.startErr = err
+	if srv.failedChan == nil {
+		srv.failedChan = make(chan struct{})
+	}
+	closeOnce(srv.failedChan)
+	if srv.State() == StateIdle {
+		if srv.stopChan == nil {
+			srv.stopChan = make(chan struct{})
+		}
+		closeOnce(srv.stopChan)
+	}
+	return err
+}
+
+func closeOnce(c chan struct{}) {
+	select {
+	case <-c:
+	default:
+		close(c)
+	}
+}
+
+// Addrs returns the addresses the server listens on, or nil if it is not
+// serving. Unlike the Addr of the http.Server, they are resolved, so that
+// ":0" gives way to the actual port.
+func (srv *Server) Addrs() []net.Addr {
+	if !srv.State().running() {
+		return nil
+	}
+	r, ok := srv.run.Load().(*run)
+	if !ok {
+		return nil
+	}
+	addrs, _ := r.addrs.Load().([]net.Addr)
+	return append([]net.Addr(nil), addrs...)
+}
+
+// listening records the address of the run, then notifies OnListen and
+// the Ready channel.
+func (srv *Server) listening(r *run, addr net.Addr) {
+	addrs := []net.Addr{addr}
+	r.addrs.Store(addrs)
+	srv.log(LevelDebug, "listening", "addrs", addrs)
+
+	if srv.OnListen != nil {
+		srv.OnListen(append([]net.Addr(nil), addrs...))
+	}
+
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	closeOnce(srv.readyChan)
+}
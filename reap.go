@@ -0,0 +1,100 @@
+package graceful
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+// idleQueue holds idle connections in the order they went idle, oldest
+// first, which is also the order of their idleSince as the clock never goes
+// back.
+type idleQueue struct {
+	order    list.List
+	elements map[net.Conn]*list.Element
+}
+
+func newIdleQueue() *idleQueue {
+	return &idleQueue{elements: map[net.Conn]*list.Element{}}
+}
+
+// push adds conn as the newest idle connection.
+func (q *idleQueue) push(conn net.Conn) {
+	q.remove(conn)
+	q.elements[conn] = q.order.PushBack(conn)
+}
+
+func (q *idleQueue) remove(conn net.Conn) {
+	if e, ok := q.elements[conn]; ok {
+		q.order.Remove(e)
+		delete(q.elements, conn)
+	}
+}
+
+// oldest returns the connection which has been idle the longest, or nil.
+func (q *idleQueue) oldest() net.Conn {
+	if e := q.order.Front(); e != nil {
+		return e.Value.(net.Conn)
+	}
+	return nil
+}
+
+func (q *idleQueue) len() int {
+	return len(q.elements)
+}
+
+// reaps reports whether idle keep-alive connections are reaped while the
+// server is serving.
+func (srv *Server) reaps() bool {
+	return srv.ReapIdleAfter > 0 || srv.MaxIdleConnections > 0
+}
+
+// keepAlive records that conn went idle after serving a request, so that
+// it may be reaped. The connection manager must be the caller.
+func (srv *Server) keepAlive(r *run, conn net.Conn, now time.Time) {
+	info := srv.connInfo[conn]
+	if info == nil || info.requests == 0 || info.closed {
+		return
+	}
+	info.idleSince = now
+	if !srv.reaps() {
+		return
+	}
+	srv.keptAlive.push(conn)
+
+	// close the oldest idle connections first, so that the most recently
+	// used ones, which clients are likeliest to reuse, are kept.
+	for max := srv.MaxIdleConnections; max > 0 && srv.keptAlive.len() > max; {
+		srv.reap(r, srv.keptAlive.oldest(), "idle connections over the maximum")
+		srv.reapedOverCap.Add(1)
+	}
+}
+
+// reapIdle closes the keep-alive connections which have been idle for
+// longer than ReapIdleAfter. The connection manager must be the caller.
+func (srv *Server) reapIdle(r *run, now time.Time) {
+	if srv.ReapIdleAfter <= 0 {
+		return
+	}
+	// stop at the first connection which has not been idle long enough, as
+	// the next ones went idle after it.
+	for conn := srv.keptAlive.oldest(); conn != nil; conn = srv.keptAlive.oldest() {
+		if now.Sub(srv.connInfo[conn].idleSince) < srv.ReapIdleAfter {
+			return
+		}
+		srv.reap(r, conn, "idle timeout")
+		srv.reapedIdle.Add(1)
+	}
+}
+
+func (srv *Server) reap(r *run, conn net.Conn, reason string) {
+	srv.log(LevelDebug, "idle connection reaped", "remote", conn.RemoteAddr(), "reason", reason)
+	srv.closeIdle(r, conn)
+}
+
+// ReapedCounts returns the number of idle keep-alive connections closed
+// because they reached ReapIdleAfter, and because there were more than
+// MaxIdleConnections, since the server was created.
+func (srv *Server) ReapedCounts() (idleTimeout, overCap int) {
+	return int(srv.reapedIdle.Load()), int(srv.reapedOverCap.Load())
+}
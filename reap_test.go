@@ -0,0 +1,136 @@
+package graceful
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+// keepAliveRequest sends a request on conn and reads its response, leaving
+// the connection idle.
+func keepAliveRequest(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	t.Helper()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+}
+
+// expectOpen fails if the server closes conn within waitTime.
+func expectOpen(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(waitTime))
+	if _, err := br.ReadByte(); err == io.EOF {
+		t.Fatal("expected the connection to be kept open")
+	}
+}
+
+func TestMaxIdleConnections(t *testing.T) {
+	pl := NewPipeListener()
+	srv := &Server{
+		NoSignalHandling:   true,
+		MaxIdleConnections: 1,
+		Server:             &http.Server{Handler: http.HandlerFunc(okHandler)},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		conn, err := pl.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		keepAliveRequest(t, conn, br)
+		time.Sleep(waitTime / 2)
+		conns, readers = append(conns, conn), append(readers, br)
+	}
+
+	// The connection idle for the longest is closed.
+	expectClosed(t, conns[0], readers[0])
+	expectOpen(t, conns[1], readers[1])
+	if idle, overCap := srv.ReapedCounts(); idle != 0 || overCap != 1 {
+		t.Fatalf("expected 1 connection to be reaped over the cap, got %d idle and %d over the cap", idle, overCap)
+	}
+}
+
+func TestReapIdleAfter(t *testing.T) {
+	pl := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	connState, states := connStates()
+	srv := &Server{
+		NoSignalHandling: true,
+		Clock:            clock,
+		ReapIdleAfter:    time.Minute,
+		ConnState:        connState,
+		Server:           &http.Server{Handler: http.HandlerFunc(okHandler)},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	// A connection which has not sent a request yet is not kept alive.
+	fresh, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	keepAliveRequest(t, conn, br)
+	awaitState(t, states, http.StateIdle)
+
+	clock.Advance(time.Minute / 2)
+	expectOpen(t, conn, br)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	expectClosed(t, conn, br)
+	expectOpen(t, fresh, bufio.NewReader(fresh))
+	if idle, overCap := srv.ReapedCounts(); idle != 1 || overCap != 0 {
+		t.Fatalf("expected 1 connection to be reaped once idle, got %d idle and %d over the cap", idle, overCap)
+	}
+}
+
+func TestIdleQueue(t *testing.T) {
+	a, b, c := &pipeConn{}, &pipeConn{}, &pipeConn{}
+	q := newIdleQueue()
+	q.push(a)
+	q.push(b)
+	q.push(c)
+	// a connection going idle again becomes the newest.
+	q.push(a)
+	q.remove(b)
+
+	if n := q.len(); n != 2 {
+		t.Fatalf("expected 2 idle connections, got %d", n)
+	}
+	for _, want := range []net.Conn{c, a, nil} {
+		if got := q.oldest(); got != want {
+			t.Fatalf("expected the oldest idle connection to be %p, got %p", want, got)
+		}
+		if want != nil {
+			q.remove(want)
+		}
+	}
+}
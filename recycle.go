@@ -0,0 +1,149 @@
+package graceful
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// connInfo is what the connection manager knows about a connection, beyond
+// whether it is idle.
+type connInfo struct {
+	// added is when the connection was accepted, and maxAge the age after
+	// which it is recycled, jitter included. maxAge is zero if connections
+	// are not recycled by age.
+	added  time.Time
+	maxAge time.Duration
+
+	// requests is the number of times the connection became active, and
+	// idleSince when it last went idle after one.
+	requests  int
+	idleSince time.Time
+
+	// recycle is set once the connection has crossed a limit, and closed
+	// once graceful has closed it.
+	recycle bool
+	closed  bool
+}
+
+func (srv *Server) newConnInfo(now time.Time) *connInfo {
+	info := &connInfo{added: now, maxAge: srv.MaxConnectionAge}
+	if info.maxAge > 0 && srv.MaxConnectionAgeJitter > 0 {
+		info.maxAge += time.Duration(rand.Int63n(int64(srv.MaxConnectionAgeJitter)))
+	}
+	return info
+}
+
+// recycles reports whether connections are recycled once they cross a
+// limit.
+func (srv *Server) recycles() bool {
+	return srv.MaxConnectionAge > 0 || srv.MaxRequestsPerConnection > 0
+}
+
+// sweepInterval returns how often the connection manager checks the age of
+// connections and for how long they have been idle, or zero if it does not.
+func (srv *Server) sweepInterval() time.Duration {
+	var interval time.Duration
+	for _, limit := range []time.Duration{srv.MaxConnectionAge, srv.ReapIdleAfter, srv.FirstRequestTimeout} {
+		if limit > 0 && (interval == 0 || limit/10 < interval) {
+			interval = limit / 10
+		}
+	}
+	if interval == 0 {
+		return 0
+	}
+	if interval > time.Second {
+		interval = time.Second
+	}
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	return interval
+}
+
+// markRecycled records that conn crossed a limit, so that it is closed once
+// idle, and that requests it still carries ask the client to close it. The
+// connection manager must be the caller.
+func (srv *Server) markRecycled(r *run, conn net.Conn, reason string) {
+	info := srv.connInfo[conn]
+	if info == nil || info.recycle {
+		return
+	}
+	info.recycle = true
+	r.recycled.Store(conn, struct{}{})
+	srv.log(LevelDebug, "connection recycled", "remote", conn.RemoteAddr(), "reason", reason)
+	srv.traceEvent(r, conn, "recycled")
+}
+
+// closeRecycled closes conn if it crossed a limit and is idle, through the
+// same path as idle connections closed during shutdown. The connection
+// manager must be the caller.
+func (srv *Server) closeRecycled(r *run, conn net.Conn) {
+	info := srv.connInfo[conn]
+	if info == nil || !info.recycle || info.closed {
+		return
+	}
+	if _, idle := srv.idleConnections[conn]; !idle {
+		return
+	}
+	srv.closeIdle(r, conn)
+}
+
+// closeIdle closes an idle connection while the server is serving, through
+// the same path as idle connections closed during shutdown. The connection
+// manager must be the caller.
+func (srv *Server) closeIdle(r *run, conn net.Conn) {
+	if info := srv.connInfo[conn]; info != nil {
+		info.closed = true
+	}
+	delete(srv.idleConnections, conn)
+	srv.keptAlive.remove(conn)
+	delete(srv.newConnections, conn)
+	srv.traceClosed(r, conn, false)
+	srv.closeConn(conn)
+}
+
+// sweep recycles the connections which outlived their maximum age, reaps
+// those which have been idle for too long, and cuts those which are too
+// slow to send their first request. The connection manager must be the
+// caller.
+func (srv *Server) sweep(r *run, now time.Time) {
+	if srv.MaxConnectionAge > 0 {
+		for conn, info := range srv.connInfo {
+			if info.maxAge > 0 && now.Sub(info.added) >= info.maxAge {
+				srv.markRecycled(r, conn, "age")
+				srv.closeRecycled(r, conn)
+			}
+		}
+	}
+	srv.reapIdle(r, now)
+	srv.cutSlowConnections(r, now)
+}
+
+// connKey is the context key under which the connection of a request is
+// stored, when connections are recycled or requests waited for.
+type connKey struct{}
+
+func (srv *Server) connContext(ctx context.Context, conn net.Conn) context.Context {
+	ctx = context.WithValue(ctx, connKey{}, conn)
+	if srv.hookedConnContext != nil {
+		return srv.hookedConnContext(ctx, conn)
+	}
+	return ctx
+}
+
+// recycling reports whether the connection carrying r crossed a limit.
+func (srv *Server) recycling(r *http.Request) bool {
+	conn, ok := r.Context().Value(connKey{}).(net.Conn)
+	if !ok {
+		return false
+	}
+	run, ok := srv.run.Load().(*run)
+	if !ok {
+		return false
+	}
+	_, recycled := run.recycled.Load(conn)
+	return recycled
+}
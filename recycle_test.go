@@ -0,0 +1,171 @@
+package graceful
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+func okHandler(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Content-Length", "2")
+	rw.Write([]byte("ok"))
+}
+
+// expectClosed fails unless the server closes conn within timeoutTime.
+func expectClosed(t *testing.T, conn net.Conn, br *bufio.Reader) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeoutTime))
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+// connStates returns a ConnState callback which reports the states of
+// connections on the returned channel, once the connection manager has
+// been told about them.
+func connStates() (func(net.Conn, http.ConnState), <-chan http.ConnState) {
+	states := make(chan http.ConnState, 16)
+	return func(conn net.Conn, state http.ConnState) {
+		select {
+		case states <- state:
+		default:
+		}
+	}, states
+}
+
+// awaitState waits until a connection reaches state.
+func awaitState(t *testing.T, states <-chan http.ConnState, state http.ConnState) {
+	t.Helper()
+	timeout := time.After(timeoutTime)
+	for {
+		select {
+		case s := <-states:
+			if s == state {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out while waiting for a connection to be %s", state)
+		}
+	}
+}
+
+// awaitOpen waits until the server tracks n open connections.
+func awaitOpen(t *testing.T, srv *Server, n int) {
+	t.Helper()
+	timeout := time.After(timeoutTime)
+	for {
+		if open, _ := srv.ConnectionCounts(); open == n {
+			return
+		}
+		select {
+		case <-timeout:
+			t.Fatalf("Timed out while waiting for %d open connections", n)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+func TestMaxRequestsPerConnection(t *testing.T) {
+	pl := NewPipeListener()
+	srv := &Server{
+		NoSignalHandling:         true,
+		MaxRequestsPerConnection: 2,
+		Server:                   &http.Server{Handler: http.HandlerFunc(okHandler)},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for i := 1; i <= 2; i++ {
+		go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		if i == 1 && res.Close {
+			t.Fatal("expected the connection to be kept alive after the first request")
+		}
+	}
+	expectClosed(t, conn, br)
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	pl := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	connState, states := connStates()
+	srv := &Server{
+		NoSignalHandling:       true,
+		Clock:                  clock,
+		MaxConnectionAge:       time.Minute,
+		MaxConnectionAgeJitter: time.Second,
+		ConnState:              connState,
+		Server:                 &http.Server{Handler: http.HandlerFunc(okHandler)},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	if res.Close {
+		t.Fatal("expected a young connection to be kept alive")
+	}
+	awaitState(t, states, http.StateIdle)
+
+	clock.Advance(time.Minute / 2)
+	expectOpen(t, conn, br)
+
+	// The idle connection is closed once it is too old.
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	expectClosed(t, conn, br)
+}
+
+func TestRecycledConnectionClose(t *testing.T) {
+	srv := &Server{MaxConnectionAge: time.Minute, Server: &http.Server{Handler: http.HandlerFunc(okHandler)}}
+	srv.installHooks()
+	r := srv.newRun()
+	srv.run.Store(r)
+
+	// Requests on a recycled connection ask the client to close it, which
+	// net/http turns into a GOAWAY for HTTP/2.
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	r.recycled.Store(conn, struct{}{})
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(srv.Server.ConnContext(req.Context(), conn))
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, req)
+	if rec.Header().Get("Connection") != "close" {
+		t.Fatalf("expected the response to close the connection, got headers %v", rec.Header())
+	}
+}
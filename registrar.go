@@ -0,0 +1,147 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Registrar registers a server with a service discovery catalog.
+type Registrar interface {
+	// Register announces that the server accepts connections on addr.
+	Register(ctx context.Context, addr net.Addr) error
+
+	// Deregister withdraws the announcement made by Register.
+	Deregister(ctx context.Context, addr net.Addr) error
+}
+
+const (
+	defaultRegisterAttempts = 3
+	defaultRegisterTimeout  = 5 * time.Second
+	registerBackoff         = 100 * time.Millisecond
+)
+
+// register registers the address the server listens on with the
+// Registrar, if any.
+func (srv *Server) register(r *run, addr net.Addr) error {
+	if srv.Registrar == nil {
+		return nil
+	}
+	if err := srv.retryRegistrar(context.Background(), "register", srv.Registrar.Register, addr); err != nil {
+		return err
+	}
+	r.registerLock.Lock()
+	r.registered = addr
+	r.registerLock.Unlock()
+	return nil
+}
+
+// deregister withdraws the registration of the run, if it is still
+// registered.
+func (srv *Server) deregister(ctx context.Context, r *run) {
+	r.registerLock.Lock()
+	addr := r.registered
+	r.registered = nil
+	r.registerLock.Unlock()
+	if addr == nil {
+		return
+	}
+	if err := srv.retryRegistrar(ctx, "deregister", srv.Registrar.Deregister, addr); err != nil {
+		srv.log(LevelError, "deregister failed", "addr", addr, "error", err)
+	}
+}
+
+// retryRegistrar calls fn until it succeeds, up to RegisterAttempts times,
+// giving each attempt RegisterTimeout.
+func (srv *Server) retryRegistrar(ctx context.Context, op string, fn func(context.Context, net.Addr) error, addr net.Addr) error {
+	attempts := srv.RegisterAttempts
+	if attempts <= 0 {
+		attempts = defaultRegisterAttempts
+	}
+	timeout := srv.RegisterTimeout
+	if timeout <= 0 {
+		timeout = defaultRegisterTimeout
+	}
+
+	backoff := registerBackoff
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := fn(attemptCtx, addr)
+		cancel()
+		if err == nil {
+			srv.log(LevelInfo, op+"ed", "addr", addr)
+			return nil
+		}
+		if attempt >= attempts || ctx.Err() != nil {
+			return err
+		}
+
+		srv.log(LevelWarn, op+" failed, retrying", "addr", addr, "attempt", attempt, "retry_in", backoff, "error", err)
+		select {
+		case <-srv.clock().After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// MemoryRegistrar is a Registrar keeping registrations in memory, such as
+// to stand in for a service discovery catalog in tests.
+type MemoryRegistrar struct {
+	// Err, if set, is called before each operation, with op being either
+	// "register" or "deregister". A non-nil error fails the operation.
+	Err func(op string, addr net.Addr) error
+
+	mu    sync.Mutex
+	addrs map[string]net.Addr
+}
+
+// Register implements Registrar.
+func (m *MemoryRegistrar) Register(ctx context.Context, addr net.Addr) error {
+	if m.Err != nil {
+		if err := m.Err("register", addr); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.addrs == nil {
+		m.addrs = map[string]net.Addr{}
+	}
+	m.addrs[addr.Network()+"|"+addr.String()] = addr
+	return nil
+}
+
+// Deregister implements Registrar.
+func (m *MemoryRegistrar) Deregister(ctx context.Context, addr net.Addr) error {
+	if m.Err != nil {
+		if err := m.Err("deregister", addr); err != nil {
+			return err
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.addrs, addr.Network()+"|"+addr.String())
+	return nil
+}
+
+// Registered returns the registered addresses, sorted by their string
+// form.
+func (m *MemoryRegistrar) Registered() []net.Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	addrs := make([]net.Addr, 0, len(m.addrs))
+	for _, addr := range m.addrs {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].String() < addrs[j].String()
+	})
+	return addrs
+}
@@ -0,0 +1,168 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// InFlightRequest describes a request being handled by a handler wrapped
+// with TrackRequests, or by the Handler if WaitForRequests is set.
+type InFlightRequest struct {
+	Method     string
+	Path       string
+	RemoteAddr string
+
+	// Start is when the handler was called, as given by the server's Clock.
+	Start time.Time
+}
+
+// requestTracker holds the requests in flight.
+type requestTracker struct {
+	mu       sync.Mutex
+	requests map[*InFlightRequest]struct{}
+
+	// idle is closed once no request is in flight. It is nil while none
+	// is.
+	idle chan struct{}
+}
+
+func (t *requestTracker) add(req *InFlightRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.requests == nil {
+		t.requests = map[*InFlightRequest]struct{}{}
+	}
+	if len(t.requests) == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.requests[req] = struct{}{}
+}
+
+func (t *requestTracker) remove(req *InFlightRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.requests, req)
+	if len(t.requests) == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// ifIdle calls fn if no request is in flight, and reports whether it did.
+// Requests beginning meanwhile wait for fn to return.
+func (t *requestTracker) ifIdle(fn func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.requests) > 0 {
+		return false
+	}
+	fn()
+	return true
+}
+
+// done returns a channel which is closed once no request is in flight.
+func (t *requestTracker) done() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.idle == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return t.idle
+}
+
+func (t *requestTracker) list() []InFlightRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	requests := make([]InFlightRequest, 0, len(t.requests))
+	for req := range t.requests {
+		requests = append(requests, *req)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		return requests[i].Start.Before(requests[j].Start)
+	})
+	return requests
+}
+
+// trackedKey marks the context of requests which are already tracked.
+type trackedKey struct{}
+
+// track records r as in flight until the returned function is called, and
+// returns r marked as tracked.
+func (srv *Server) track(r *http.Request) (*http.Request, func()) {
+	req := &InFlightRequest{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		Start:      srv.clock().Now(),
+	}
+	srv.requests.add(req)
+	r = r.WithContext(context.WithValue(r.Context(), trackedKey{}, struct{}{}))
+	return r, func() { srv.requests.remove(req) }
+}
+
+// TrackRequests wraps h so that the requests it handles are reported by
+// InFlight. It is not needed if WaitForRequests is set, as every request is
+// then tracked before reaching the Handler.
+func (srv *Server) TrackRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(trackedKey{}) == nil {
+			var untrack func()
+			r, untrack = srv.track(r)
+			defer untrack()
+		}
+		h.ServeHTTP(rw, r)
+	})
+}
+
+// waitHandler tracks the requests handed to the underlying http.Server's
+// Handler, for WaitForRequests, and records which connections carry
+// HTTP/2 requests.
+type waitHandler struct {
+	srv     *Server
+	handler http.Handler
+}
+
+func (h waitHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	r, untrack := h.srv.track(r)
+	defer untrack()
+
+	if r.ProtoMajor >= 2 {
+		conn, ok := r.Context().Value(connKey{}).(net.Conn)
+		if run, running := h.srv.run.Load().(*run); ok && running {
+			run.multiplexed.Store(conn, struct{}{})
+		}
+	}
+	handler := h.handler
+	if handler == nil {
+		handler = http.DefaultServeMux
+	}
+	handler.ServeHTTP(rw, r)
+}
+
+// InFlight returns the requests being handled by handlers wrapped with
+// TrackRequests, or by the Handler if WaitForRequests is set, oldest first.
+func (srv *Server) InFlight() []InFlightRequest {
+	return srv.requests.list()
+}
+
+// reportBlocking records the requests still in flight once the shutdown
+// has run out of time.
+func (srv *Server) reportBlocking(r *run) {
+	now := srv.clock().Now()
+	r.report.Blocking = srv.InFlight()
+	for _, req := range r.report.Blocking {
+		srv.log(LevelWarn, "request blocking shutdown",
+			"method", req.Method, "path", req.Path, "remote", req.RemoteAddr, "age", now.Sub(req.Start))
+	}
+}
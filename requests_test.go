@@ -0,0 +1,254 @@
+package graceful
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+// multiplexedConn stands for an HTTP/2 connection, which net/http keeps
+// active between its streams.
+type multiplexedConn struct {
+	net.Conn
+	srv *Server
+}
+
+func (c multiplexedConn) Close() error {
+	go c.srv.connState(c, http.StateClosed)
+	return c.Conn.Close()
+}
+
+func TestTrackRequests(t *testing.T) {
+	pl := NewPipeListener()
+	release := make(chan struct{})
+	clock := fakeclock.New(time.Now())
+	srv := &Server{Timeout: time.Minute, Clock: clock, NoSignalHandling: true, Server: &http.Server{}}
+	srv.Handler = srv.TrackRequests(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer close(release)
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("POST /upload HTTP/1.1\r\nHost: pipe\r\nContent-Length: 0\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	requests := srv.InFlight()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", len(requests))
+	}
+	if req := requests[0]; req.Method != "POST" || req.Path != "/upload" || req.Start.IsZero() {
+		t.Fatalf("unexpected request in flight %+v", req)
+	}
+
+	srv.Stop(time.Minute)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-srv.StopChan()
+
+	blocking := srv.ShutdownReport().Blocking
+	if len(blocking) != 1 || blocking[0].Path != "/upload" {
+		t.Fatalf("expected the request to be reported as blocking the shutdown, got %+v", blocking)
+	}
+}
+
+func TestWaitForRequests(t *testing.T) {
+	pl := NewPipeListener()
+	release := make(chan struct{})
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		WaitForRequests:  true,
+		Server:           &http.Server{},
+	}
+	srv.Handler = srv.TrackRequests(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go io.Copy(io.Discard, conn)
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+
+	// A multiplexed connection stays active without carrying any request,
+	// once it has carried HTTP/2 ones.
+	server, client := net.Pipe()
+	defer client.Close()
+	mc := multiplexedConn{server, srv}
+	srv.connState(mc, http.StateNew)
+	srv.connState(mc, http.StateActive)
+	srv.run.Load().(*run).multiplexed.Store(mc, struct{}{})
+	time.Sleep(waitTime)
+
+	start := time.Now()
+	srv.Stop(timeoutTime)
+	time.Sleep(waitTime)
+	close(release)
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime / 2):
+		t.Fatal("Timed out while waiting for the shutdown to complete once requests finished")
+	}
+	if elapsed := time.Since(start); elapsed >= timeoutTime {
+		t.Fatalf("expected the shutdown to complete before the timeout, took %s", elapsed)
+	}
+	report := srv.ShutdownReport()
+	if report.Killed != 0 || len(report.Blocking) != 0 {
+		t.Fatalf("expected nothing to be killed, got %+v", report)
+	}
+}
+
+func TestWaitForRequestsRechecks(t *testing.T) {
+	pl := NewPipeListener()
+	srv := &Server{NoSignalHandling: true, WaitForRequests: true, Server: &http.Server{}}
+	go srv.Serve(pl)
+	<-srv.Ready()
+	defer srv.Stop(0)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	mc := multiplexedConn{server, srv}
+	srv.connState(mc, http.StateNew)
+	srv.connState(mc, http.StateActive)
+	r := srv.run.Load().(*run)
+	r.multiplexed.Store(mc, struct{}{})
+
+	// A request begins once the shutdown has seen none in flight, but
+	// before the connection manager closes the HTTP/2 connections.
+	req := &InFlightRequest{}
+	srv.requests.add(req)
+	closed := make(chan bool, 1)
+	r.closeAll <- closed
+	if <-closed {
+		t.Fatal("expected the connections to be left open while a request is in flight")
+	}
+
+	srv.requests.remove(req)
+	r.closeAll <- closed
+	if !<-closed {
+		t.Fatal("expected the connections to be closed once no request is in flight")
+	}
+	client.SetReadDeadline(time.Now().Add(timeoutTime))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the HTTP/2 connection to be closed, got %v", err)
+	}
+}
+
+func TestWaitForRequestsInFlight(t *testing.T) {
+	pl := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Timeout:          time.Minute,
+		Clock:            clock,
+		NoSignalHandling: true,
+		WaitForRequests:  true,
+		Server:           &http.Server{},
+	}
+	// TrackRequests does not count the requests WaitForRequests tracks
+	// again.
+	srv.Handler = srv.TrackRequests(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	requests := srv.InFlight()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", len(requests))
+	}
+	if req := requests[0]; req.Method != "GET" || req.Path != "/slow" || req.RemoteAddr == "" || req.Start.IsZero() {
+		t.Fatalf("unexpected request in flight %+v", req)
+	}
+
+	srv.Stop(time.Minute)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-srv.StopChan()
+
+	blocking := srv.ShutdownReport().Blocking
+	if len(blocking) != 1 || blocking[0].Path != "/slow" {
+		t.Fatalf("expected the request to be reported as blocking the shutdown, got %+v", blocking)
+	}
+}
+
+func TestWaitForRequestsBeforeHandler(t *testing.T) {
+	pl := NewPipeListener()
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	srv := &Server{
+		Timeout:          timeoutTime,
+		NoSignalHandling: true,
+		WaitForRequests:  true,
+		Server:           &http.Server{},
+	}
+	// The request is held in front of TrackRequests, so it has been read
+	// but is not tracked yet when the shutdown begins.
+	tracked := srv.TrackRequests(http.HandlerFunc(okHandler))
+	srv.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(entered)
+		<-release
+		tracked.ServeHTTP(rw, r)
+	})
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	select {
+	case <-entered:
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the request")
+	}
+
+	srv.Stop(timeoutTime)
+	time.Sleep(waitTime)
+	close(release)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("expected the request to be answered, got %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime / 2):
+		t.Fatal("Timed out while waiting for the shutdown to complete once the request finished")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 0 {
+		t.Fatalf("expected nothing to be killed, got %+v", report)
+	}
+}
@@ -0,0 +1,140 @@
+package graceful
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RouteDrain describes how the requests of a route behave once the server
+// drains.
+//
+// Example:
+//
+//	srv := &graceful.Server{
+//		Timeout: 10 * time.Second,
+//		Routes: map[string]graceful.RouteDrain{
+//			"/upload":  {Grace: time.Minute},
+//			"/poll":    {Cancel: true},
+//			"/healthz": {AlwaysServe: true},
+//		},
+//		Server: &http.Server{Addr: ":1234", Handler: mux},
+//	}
+type RouteDrain struct {
+	// Grace extends the time the requests are given to finish. While one
+	// of them is in flight, the shutdown does not escalate, whether to
+	// cancel request contexts, set deadlines or kill connections, until
+	// Grace has elapsed since the listener was closed. ShutdownBudget still
+	// applies.
+	Grace time.Duration
+
+	// Cancel cancels the context of the requests as soon as the listener is
+	// closed, such as for long polls which clients reissue elsewhere.
+	Cancel bool
+
+	// AlwaysServe serves the requests which begin once the server drains,
+	// rather than rejecting them with the DrainPolicy, such as for health
+	// checks.
+	AlwaysServe bool
+}
+
+// routeHandler marks the patterns of Routes in the ServeMux used to match
+// requests against them.
+type routeHandler RouteDrain
+
+func (routeHandler) ServeHTTP(http.ResponseWriter, *http.Request) {}
+
+// compileRoutes builds the ServeMux matching requests against Routes.
+func (srv *Server) compileRoutes() {
+	srv.routes = nil
+	if len(srv.Routes) == 0 {
+		return
+	}
+	srv.routes = http.NewServeMux()
+	for pattern, route := range srv.Routes {
+		srv.routes.Handle(pattern, routeHandler(route))
+	}
+}
+
+// route returns the drain behavior of the route matching r.
+func (srv *Server) route(r *http.Request) RouteDrain {
+	if srv.routes == nil {
+		return RouteDrain{}
+	}
+	h, _ := srv.routes.Handler(r)
+	route, _ := h.(routeHandler)
+	return RouteDrain(route)
+}
+
+// graceTracker holds the requests in flight with an extended grace.
+type graceTracker struct {
+	mu       sync.Mutex
+	requests map[*http.Request]time.Duration
+
+	// changed is closed, and reset, when a request starts or finishes.
+	changed chan struct{}
+}
+
+func (t *graceTracker) add(r *http.Request, grace time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.requests == nil {
+		t.requests = map[*http.Request]time.Duration{}
+	}
+	t.requests[r] = grace
+	t.notify()
+}
+
+func (t *graceTracker) remove(r *http.Request) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.requests, r)
+	t.notify()
+}
+
+// notify wakes up the callers of max. mu must be held.
+func (t *graceTracker) notify() {
+	if t.changed != nil {
+		close(t.changed)
+		t.changed = nil
+	}
+}
+
+// max returns the longest grace of the requests in flight, and a channel
+// which is closed once it may have changed.
+func (t *graceTracker) max() (grace time.Duration, changed <-chan struct{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, g := range t.requests {
+		if g > grace {
+			grace = g
+		}
+	}
+	if t.changed == nil {
+		t.changed = make(chan struct{})
+	}
+	return grace, t.changed
+}
+
+// serveRoute applies the drain behavior of route to r, and serves it with
+// handler.
+func (srv *Server) serveRoute(route RouteDrain, handler http.Handler, rw http.ResponseWriter, r *http.Request) {
+	if route.Cancel {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		if run, ok := srv.run.Load().(*run); ok {
+			stop := context.AfterFunc(run.drainCtx, cancel)
+			defer stop()
+		}
+		r = r.WithContext(ctx)
+	}
+	if route.Grace > 0 {
+		srv.grace.add(r, route.Grace)
+		defer srv.grace.remove(r)
+	}
+	handler.ServeHTTP(rw, r)
+}
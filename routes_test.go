@@ -0,0 +1,106 @@
+package graceful
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+func TestRoutes(t *testing.T) {
+	pl := NewPipeListener()
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+			// the escalation resumes once the handler returns.
+			rw.WriteHeader(http.StatusOK)
+			rw.(http.Flusher).Flush()
+		case <-r.Context().Done():
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	mux.HandleFunc("/poll", func(rw http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		rw.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {})
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Timeout:          time.Minute,
+		Clock:            clock,
+		NoSignalHandling: true,
+		DrainPolicy:      &DrainPolicy{},
+		Routes: map[string]RouteDrain{
+			"/upload":  {Grace: time.Hour},
+			"/poll":    {Cancel: true},
+			"/healthz": {AlwaysServe: true},
+		},
+		Server: &http.Server{Handler: mux},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	request := func(path string) net.Conn {
+		conn, err := pl.Dial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go conn.Write([]byte("GET " + path + " HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+		return conn
+	}
+	upload := request("/upload")
+	defer upload.Close()
+	poll := request("/poll")
+	defer poll.Close()
+	time.Sleep(waitTime)
+
+	srv.Stop(time.Minute)
+
+	// The long poll is cancelled right away.
+	poll.SetReadDeadline(time.Now().Add(killTime / 2))
+	res, err := http.ReadResponse(bufio.NewReader(poll), nil)
+	if err != nil {
+		t.Fatalf("expected the long poll to be cancelled once the server drains: %v", err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected the long poll to answer with status %d, got %d", http.StatusNoContent, res.StatusCode)
+	}
+
+	// Health checks are served during the drain, other requests are not.
+	for path, status := range map[string]int{"/healthz": http.StatusOK, "/other": http.StatusServiceUnavailable} {
+		rec := httptest.NewRecorder()
+		srv.Handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != status {
+			t.Errorf("expected %s to answer with status %d during the drain, got %d", path, status, rec.Code)
+		}
+	}
+
+	// The upload outlives the server's Timeout.
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Minute)
+	select {
+	case <-srv.StopChan():
+		t.Fatal("expected the upload to hold the shutdown back")
+	case <-time.After(waitTime):
+	}
+	close(release)
+	res, err = http.ReadResponse(bufio.NewReader(upload), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected the upload to complete with status %d, got %d", http.StatusOK, res.StatusCode)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop once the upload finished")
+	}
+}
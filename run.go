@@ -0,0 +1,259 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// run holds the state of a single call to Serve.
+type run struct {
+	// ctx is the base context of requests, cancelled during shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// drainCtx is cancelled once the listener is closed, for the routes
+	// which cancel their requests right away.
+	drainCtx    context.Context
+	drainCancel context.CancelFunc
+
+	// add, idle, active and remove relay connection state changes to the
+	// connection manager.
+	add, idle, active, remove chan net.Conn
+
+	// shutdown requests the connection manager to notify the given channel
+	// once all connections are closed.
+	shutdown chan chan struct{}
+
+	// deadline requests the connection manager to close idle connections
+	// and set the given deadline on the others.
+	deadline chan time.Time
+
+	// kill is closed to make the connection manager close every connection.
+	kill     chan struct{}
+	killOnce sync.Once
+
+	// closeAll makes the connection manager close the idle and HTTP/2
+	// connections if no request is in flight, reporting on the given
+	// channel whether it did.
+	closeAll chan chan bool
+
+	// multiplexed holds the connections which carried HTTP/2 requests,
+	// when WaitForRequests is set.
+	multiplexed sync.Map
+
+	// stop carries the timeout of a Stop called once the shutdown has
+	// begun, which moves its kill stage.
+	stop chan time.Duration
+
+	// managed is closed once the connection manager returns, after which
+	// state changes of killed connections are no longer tracked.
+	managed chan struct{}
+
+	// openCount and idleCount mirror the number of connections tracked by
+	// the connection manager, for reading from other goroutines.
+	openCount, idleCount atomic.Int64
+
+	// delayStarted and delay record the shutdown delay, which happens before
+	// the shutdown sequence, in the interrupt handler.
+	delayLock    sync.Mutex
+	delayStarted time.Time
+	delay        time.Duration
+
+	// addrs are the addresses served by the run, once it is listening.
+	addrs atomic.Value
+
+	// registered is the address registered with the Registrar, until it is
+	// deregistered.
+	registerLock sync.Mutex
+	registered   net.Addr
+
+	// spans holds the span of each tracked connection, when the server has
+	// a Tracer.
+	spans sync.Map
+
+	// shutdownSpan is the span of the shutdown, started once by
+	// Server.shutdownSpan.
+	shutdownSpan     Span
+	shutdownSpanOnce sync.Once
+
+	// recycled holds the connections which crossed MaxConnectionAge or
+	// MaxRequestsPerConnection, for handlers to read.
+	recycled sync.Map
+
+	// report is filled in by the connection manager and the shutdown
+	// sequence, and is only read once both have finished.
+	report ShutdownReport
+}
+
+func (srv *Server) newRun() *run {
+	ctx, cancel := context.WithCancel(context.Background())
+	drainCtx, drainCancel := context.WithCancel(context.Background())
+	return &run{
+		ctx:         ctx,
+		cancel:      cancel,
+		drainCtx:    drainCtx,
+		drainCancel: drainCancel,
+		add:         make(chan net.Conn),
+		idle:        make(chan net.Conn),
+		active:      make(chan net.Conn),
+		remove:      make(chan net.Conn),
+		shutdown:    make(chan chan struct{}),
+		deadline:    make(chan time.Time),
+		kill:        make(chan struct{}),
+		closeAll:    make(chan chan bool),
+		stop:        make(chan time.Duration, 1),
+		managed:     make(chan struct{}),
+	}
+}
+
+// delayed returns when the shutdown delay started and how long it lasted,
+// and reports whether the shutdown was delayed.
+func (r *run) delayed() (started time.Time, delay time.Duration, ok bool) {
+	r.delayLock.Lock()
+	defer r.delayLock.Unlock()
+
+	return r.delayStarted, r.delay, !r.delayStarted.IsZero()
+}
+
+func (r *run) track(ch chan net.Conn, conn net.Conn) {
+	select {
+	case ch <- conn:
+	case <-r.managed:
+	}
+}
+
+// ShutdownReport summarizes the last shutdown of a Server.
+type ShutdownReport struct {
+	// Started and Finished are the times at which the shutdown was
+	// initiated and completed, as given by the server's Clock.
+	Started  time.Time
+	Finished time.Time
+
+	// Delay is how long the server kept serving after the shutdown was
+	// initiated, due to ShutdownDelay or ShutdownDelayFunc.
+	Delay time.Duration
+
+	// Stages are the shutdown stages reached, in order.
+	Stages []ShutdownStage
+
+	// Connections is the number of connections open when the shutdown
+	// began.
+	Connections int
+
+	// IdleClosed is the number of idle connections closed by graceful.
+	IdleClosed int
+
+	// Killed is the number of connections forcefully closed.
+	Killed int
+
+	// Blocking are the requests handled with TrackRequests which were still
+	// in flight when the connections were killed, oldest first.
+	Blocking []InFlightRequest
+}
+
+// Duration returns how long the shutdown took.
+func (r ShutdownReport) Duration() time.Duration {
+	return r.Finished.Sub(r.Started)
+}
+
+// ShutdownReport returns the report of the last completed shutdown of the
+// server, or the zero ShutdownReport if it has never stopped.
+func (srv *Server) ShutdownReport() ShutdownReport {
+	srv.chanLock.RLock()
+	defer srv.chanLock.RUnlock()
+
+	return srv.report
+}
+
+// ConnectionCounts returns the number of open connections, and how many of
+// them are idle. It returns zeros when the server is not running.
+func (srv *Server) ConnectionCounts() (open, idle int) {
+	switch srv.State() {
+	case StateIdle, StateStopped:
+		return 0, 0
+	}
+	r, ok := srv.run.Load().(*run)
+	if !ok {
+		return 0, 0
+	}
+	return int(r.openCount.Load()), int(r.idleCount.Load())
+}
+
+// forceKill makes the connection manager close every connection.
+func (srv *Server) forceKill(r *run) {
+	r.killOnce.Do(func() {
+		srv.transition(StateKilling, StateServing, StatePaused, StateDraining)
+		close(r.kill)
+	})
+}
+
+// installHooks points the underlying http.Server's ConnState and BaseContext
+// at graceful, as well as its ConnContext if connections are recycled or
+// requests waited for, and puts the DrainPolicy, Routes, recycling and
+// request counting in front of its Handler. They are only set once, as
+// connections killed by a previous run may still be reading them.
+func (srv *Server) installHooks() {
+	if srv.hooked == srv.Server {
+		return
+	}
+	srv.hooked = srv.Server
+	srv.Server.ConnState = srv.connState
+	srv.hookedBaseContext = srv.Server.BaseContext
+	srv.Server.BaseContext = srv.baseContext
+	if srv.recycles() || srv.WaitForRequests {
+		srv.hookedConnContext = srv.Server.ConnContext
+		srv.Server.ConnContext = srv.connContext
+	}
+	if srv.DrainPolicy != nil || len(srv.Routes) > 0 || srv.recycles() {
+		srv.compileRoutes()
+		srv.Server.Handler = drainHandler{srv, srv.Server.Handler}
+	}
+	if srv.WaitForRequests {
+		// requests are counted before anything else runs, so that the
+		// shutdown does not overlook them.
+		srv.Server.Handler = waitHandler{srv, srv.Server.Handler}
+	}
+}
+
+func (srv *Server) connState(conn net.Conn, state http.ConnState) {
+	r := srv.run.Load().(*run)
+	srv.traceConn(r, conn, state)
+	switch state {
+	case http.StateNew:
+		r.track(r.add, conn)
+	case http.StateActive:
+		r.track(r.active, conn)
+	case http.StateIdle:
+		r.track(r.idle, conn)
+	case http.StateClosed, http.StateHijacked:
+		r.track(r.remove, conn)
+	}
+
+	// net/http calls ConnState from the goroutine of each connection, and
+	// graceful has always serialized the callback for it. It has a lock of
+	// its own, so that it never waits on Stop or the shutdown.
+	srv.connStateLock.Lock()
+	defer srv.connStateLock.Unlock()
+
+	if srv.ConnState != nil {
+		srv.ConnState(conn, state)
+	}
+}
+
+func (srv *Server) baseContext(l net.Listener) context.Context {
+	ctx := srv.run.Load().(*run).ctx
+	baseContext := srv.BaseContext
+	if baseContext == nil {
+		baseContext = srv.hookedBaseContext
+	}
+	if baseContext == nil {
+		return ctx
+	}
+	base, cancel := context.WithCancel(baseContext(l))
+	context.AfterFunc(ctx, cancel)
+	return base
+}
@@ -0,0 +1,156 @@
+package graceful
+
+import (
+	"sort"
+	"time"
+)
+
+// ShutdownStage identifies a step of the shutdown sequence.
+type ShutdownStage int
+
+const (
+	// StageDrain is reached once the listener has been closed and the server
+	// starts waiting for outstanding connections to finish.
+	StageDrain ShutdownStage = iota
+
+	// StageCancel is reached when the contexts of in-flight requests are
+	// cancelled.
+	StageCancel
+
+	// StageDeadline is reached when idle connections are closed and a
+	// deadline is set on active connections so that pending reads and writes
+	// fail cleanly.
+	StageDeadline
+
+	// StageKill is reached when all remaining connections are forcefully
+	// closed.
+	StageKill
+
+	// StageDelay is reached when the shutdown is initiated with a
+	// ShutdownDelay or ShutdownDelayFunc, before the listener is closed.
+	StageDelay
+)
+
+func (s ShutdownStage) String() string {
+	switch s {
+	case StageDrain:
+		return "drain"
+	case StageCancel:
+		return "cancel"
+	case StageDeadline:
+		return "deadline"
+	case StageKill:
+		return "kill"
+	case StageDelay:
+		return "delay"
+	}
+	return "unknown"
+}
+
+// ShutdownPolicy escalates a shutdown through several stages. Each duration
+// is measured from the moment the listener is closed; a zero duration skips
+// the stage.
+//
+// Example:
+//
+//	srv := &graceful.Server{
+//		ShutdownPolicy: &graceful.ShutdownPolicy{
+//			CancelAfter:   10 * time.Second,
+//			DeadlineAfter: 20 * time.Second,
+//			KillAfter:     30 * time.Second,
+//		},
+//		Server: &http.Server{Addr: ":1234", Handler: handler},
+//	}
+type ShutdownPolicy struct {
+	// CancelAfter is the duration after which the contexts of in-flight
+	// requests are cancelled.
+	CancelAfter time.Duration
+
+	// DeadlineAfter is the duration after which idle connections are closed
+	// and active connections are given a deadline of KillAfter, or of the
+	// current time if there is no hard deadline.
+	DeadlineAfter time.Duration
+
+	// KillAfter is the duration after which all connections are closed. If
+	// zero, the server's Timeout is used. A timeout given to Stop takes
+	// precedence over both.
+	KillAfter time.Duration
+}
+
+// stage is a shutdown stage scheduled at an offset from the start of the
+// shutdown.
+type stage struct {
+	stage ShutdownStage
+	after time.Duration
+}
+
+// shutdownStages returns the escalation stages of the shutdown in order,
+// given the time already spent since it was initiated. stopLock must be
+// held.
+func (srv *Server) shutdownStages(spent time.Duration) []stage {
+	var stages []stage
+	if p := srv.ShutdownPolicy; p != nil {
+		if p.CancelAfter > 0 {
+			stages = append(stages, stage{StageCancel, p.CancelAfter})
+		}
+		if p.DeadlineAfter > 0 {
+			stages = append(stages, stage{StageDeadline, p.DeadlineAfter})
+		}
+	}
+	return srv.scheduleKill(stages, srv.timeout(), spent)
+}
+
+// stopStages returns the remaining stages of a shutdown once Stop has
+// moved its kill stage to kill, given the time already spent before the
+// shutdown began.
+func (srv *Server) stopStages(stages []stage, kill, spent time.Duration) []stage {
+	var remaining []stage
+	for _, s := range stages {
+		if s.stage != StageKill {
+			remaining = append(remaining, s)
+		}
+	}
+	return srv.scheduleKill(remaining, kill, spent)
+}
+
+// scheduleKill adds the kill stage to stages, unless kill is zero, keeping
+// the shutdown within its budget, and returns the reachable stages in
+// order.
+func (srv *Server) scheduleKill(stages []stage, kill, spent time.Duration) []stage {
+	if budget := srv.ShutdownBudget; budget > 0 {
+		remaining := budget - spent
+		if remaining <= 0 {
+			// kill right away, as zero means never.
+			remaining = 1
+		}
+		if kill == 0 || remaining < kill {
+			kill = remaining
+		}
+	}
+	if kill > 0 {
+		stages = append(stages, stage{StageKill, kill})
+	}
+
+	// Stages scheduled at or past the hard deadline would never be reached.
+	reachable := stages[:0]
+	for _, s := range stages {
+		if s.stage == StageKill || kill == 0 || s.after < kill {
+			reachable = append(reachable, s)
+		}
+	}
+	sort.SliceStable(reachable, func(i, j int) bool {
+		return reachable[i].after < reachable[j].after
+	})
+	return reachable
+}
+
+// hardDeadline returns the offset of the kill stage, or zero if the server
+// waits indefinitely.
+func hardDeadline(stages []stage) time.Duration {
+	for _, s := range stages {
+		if s.stage == StageKill {
+			return s.after
+		}
+	}
+	return 0
+}
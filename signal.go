@@ -8,10 +8,22 @@ import (
 	"syscall"
 )
 
-func signalNotify(interrupt chan<- os.Signal) {
-	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
+func defaultSignals() []os.Signal {
+	return []os.Signal{syscall.SIGINT, syscall.SIGTERM}
 }
 
-func sendSignalInt(interrupt chan<- os.Signal) {
-	interrupt <- syscall.SIGINT
+func signalNotify(interrupt chan<- os.Signal, signals ...os.Signal) {
+	if len(signals) == 0 {
+		// signal.Notify relays every signal when none are given.
+		return
+	}
+	signal.Notify(interrupt, signals...)
+}
+
+func signalStop(interrupt chan<- os.Signal) {
+	signal.Stop(interrupt)
+}
+
+func sendStopSignal(interrupt chan<- os.Signal) {
+	interrupt <- stopSignal{}
 }
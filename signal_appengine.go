@@ -4,10 +4,18 @@ package graceful
 
 import "os"
 
-func signalNotify(interrupt chan<- os.Signal) {
+func defaultSignals() []os.Signal {
+	return nil
+}
+
+func signalNotify(interrupt chan<- os.Signal, signals ...os.Signal) {
+	// Does not notify in the case of AppEngine.
+}
+
+func signalStop(interrupt chan<- os.Signal) {
 	// Does not notify in the case of AppEngine.
 }
 
-func sendSignalInt(interrupt chan<- os.Signal) {
+func sendStopSignal(interrupt chan<- os.Signal) {
 	// Does not send in the case of AppEngine.
 }
@@ -0,0 +1,39 @@
+package graceful
+
+import (
+	"net"
+	"time"
+)
+
+// cutSlowConnections closes the connections which have not completed their
+// first request headers, or TLS handshake, within FirstRequestTimeout. The
+// connection manager must be the caller.
+func (srv *Server) cutSlowConnections(r *run, now time.Time) {
+	if srv.FirstRequestTimeout <= 0 {
+		return
+	}
+	for conn := range srv.newConnections {
+		if now.Sub(srv.connInfo[conn].added) < srv.FirstRequestTimeout {
+			continue
+		}
+		srv.log(LevelDebug, "slow connection cut", "remote", conn.RemoteAddr(), "timeout", srv.FirstRequestTimeout)
+		srv.traceEvent(r, conn, "first request timeout")
+		srv.cut.Add(1)
+		srv.closeIdle(r, conn)
+	}
+}
+
+// newConnection records that conn has not sent a request yet. The
+// connection manager must be the caller.
+func (srv *Server) newConnection(conn net.Conn) {
+	if srv.FirstRequestTimeout > 0 {
+		srv.newConnections[conn] = struct{}{}
+	}
+}
+
+// CutCount returns the number of connections closed because they did not
+// complete their first request within FirstRequestTimeout, since the server
+// was created.
+func (srv *Server) CutCount() int {
+	return int(srv.cut.Load())
+}
@@ -0,0 +1,54 @@
+package graceful
+
+import (
+	"bufio"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+func TestFirstRequestTimeout(t *testing.T) {
+	pl := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	connState, states := connStates()
+	srv := &Server{
+		NoSignalHandling:    true,
+		Clock:               clock,
+		FirstRequestTimeout: time.Minute,
+		ConnState:           connState,
+		Server:              &http.Server{Handler: http.HandlerFunc(okHandler)},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+	defer func() {
+		srv.Stop(0)
+		<-srv.StopChan()
+	}()
+
+	slow, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	go slow.Write([]byte("GET / HTTP/1.1\r\n"))
+
+	kept, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kept.Close()
+	keptReader := bufio.NewReader(kept)
+	keepAliveRequest(t, kept, keptReader)
+	awaitState(t, states, http.StateIdle)
+	clock.Advance(time.Minute)
+
+	// The connection which never completed its request headers is cut,
+	// while the one which did is left to idle.
+	expectClosed(t, slow, bufio.NewReader(slow))
+	expectOpen(t, kept, keptReader)
+	if cut := srv.CutCount(); cut != 1 {
+		t.Fatalf("expected 1 connection to be cut, got %d", cut)
+	}
+}
@@ -0,0 +1,128 @@
+package graceful
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFlusher is returned by Stream when the ResponseWriter cannot flush.
+var ErrNotFlusher = errors.New("graceful: response writer does not support flushing")
+
+// Stream is a streaming response, such as Server-Sent Events, which is told
+// when the server drains so that it can end, rather than holding the
+// shutdown back or being cut without notice.
+//
+// Example:
+//
+//	func events(rw http.ResponseWriter, r *http.Request) {
+//		stream, err := srv.Stream(rw, r)
+//		if err != nil {
+//			http.Error(rw, err.Error(), http.StatusInternalServerError)
+//			return
+//		}
+//		defer stream.Close()
+//		for {
+//			select {
+//			case msg := <-messages:
+//				stream.Send("message", msg)
+//			case <-stream.Draining():
+//				stream.Reconnect(5 * time.Second)
+//				return
+//			case <-r.Context().Done():
+//				return
+//			}
+//		}
+//	}
+type Stream struct {
+	srv      *Server
+	rw       http.ResponseWriter
+	flusher  http.Flusher
+	draining <-chan struct{}
+
+	mu        sync.Mutex
+	closeOnce sync.Once
+}
+
+// Stream registers the streaming response of a request until it is closed.
+// It sets the headers of Server-Sent Events, unless a Content-Type has
+// already been set.
+func (srv *Server) Stream(rw http.ResponseWriter, r *http.Request) (*Stream, error) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return nil, ErrNotFlusher
+	}
+	run, ok := srv.run.Load().(*run)
+	if !ok {
+		return nil, ErrNotServing
+	}
+
+	h := rw.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+	}
+	srv.streams.Add(1)
+	return &Stream{
+		srv:      srv,
+		rw:       rw,
+		flusher:  flusher,
+		draining: run.drainCtx.Done(),
+	}, nil
+}
+
+// Draining returns a channel which is closed once the server drains. The
+// handler should then send a final event, such as with Reconnect, and
+// return.
+func (s *Stream) Draining() <-chan struct{} {
+	return s.draining
+}
+
+// Send writes an event and flushes it. Each line of data is sent in its own
+// data field, and event may be empty for unnamed events.
+func (s *Stream) Send(event, data string) error {
+	var b strings.Builder
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	return s.write(b.String())
+}
+
+// Reconnect writes a final "reconnect" event telling the client to
+// reconnect after retry, which reaches another server once this one has
+// closed its listener.
+func (s *Stream) Reconnect(retry time.Duration) error {
+	return s.write(fmt.Sprintf("retry: %d\nevent: reconnect\ndata:\n\n", retry.Milliseconds()))
+}
+
+// Write writes p to the response and flushes it, for streams which are not
+// Server-Sent Events.
+func (s *Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.rw.Write(p)
+	if err == nil {
+		s.flusher.Flush()
+	}
+	return n, err
+}
+
+func (s *Stream) write(msg string) error {
+	_, err := s.Write([]byte(msg))
+	return err
+}
+
+// Close unregisters the stream. The response ends once the handler
+// returns.
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() { s.srv.streams.Add(-1) })
+	return nil
+}
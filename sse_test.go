@@ -0,0 +1,68 @@
+package graceful
+
+import (
+	"bufio"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+	pl := NewPipeListener()
+	srv := &Server{NoSignalHandling: true, Server: &http.Server{}}
+	srv.Handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		stream, err := srv.Stream(rw, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer stream.Close()
+		stream.Send("greeting", "hello\nworld")
+		<-stream.Draining()
+		stream.Reconnect(1500 * time.Millisecond)
+	})
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	conn, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte("GET /events HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected the stream to be Server-Sent Events, got %q", ct)
+	}
+
+	// The server never times out, so it only stops once the stream ends.
+	srv.Stop(0)
+	body := make(chan string)
+	go func() {
+		var b strings.Builder
+		r := bufio.NewReader(res.Body)
+		for {
+			line, err := r.ReadString('\n')
+			b.WriteString(line)
+			if err != nil {
+				break
+			}
+		}
+		body <- b.String()
+	}()
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the stream to end")
+	}
+	expected := "event: greeting\ndata: hello\ndata: world\n\nretry: 1500\nevent: reconnect\ndata:\n\n"
+	if got := <-body; got != expected {
+		t.Fatalf("Incorrect stream.\n  actual: %q\nexpected: %q\n", got, expected)
+	}
+}
@@ -0,0 +1,226 @@
+package graceful
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrServerRunning is returned by Serve when the server is already
+	// serving.
+	ErrServerRunning = errors.New("graceful: server is already running")
+
+	// ErrNotServing is returned by Pause when the server is not serving.
+	ErrNotServing = errors.New("graceful: server is not serving")
+
+	// ErrNotPaused is returned by Resume when the server is not paused.
+	ErrNotPaused = errors.New("graceful: server is not paused")
+
+	// ErrShutdownVetoed is returned by Pause when BeforeShutdown refuses to
+	// let the server drain.
+	ErrShutdownVetoed = errors.New("graceful: shutdown vetoed by BeforeShutdown")
+)
+
+// State is the lifecycle state of a Server. A Server moves from StateIdle to
+// StateServing when Serve is called, to StateDraining once its listener is
+// closed, to StateKilling if the remaining connections are forcefully closed
+// and to StateStopped once Serve returns. A stopped Server may be served
+// again. A serving Server may also be paused, and then either resumed or
+// drained.
+type State int32
+
+const (
+	// StateIdle is the state of a Server which has never been served.
+	StateIdle State = iota
+
+	// StateServing is the state of a Server accepting connections.
+	StateServing
+
+	// StateDraining is the state of a Server waiting for outstanding
+	// connections to finish after its listener was closed.
+	StateDraining
+
+	// StateKilling is the state of a Server closing its remaining
+	// connections.
+	StateKilling
+
+	// StateStopped is the state of a Server which has finished serving.
+	StateStopped
+
+	// StatePaused is the state of a Server which rejects new connections
+	// but may still resume serving.
+	StatePaused
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateServing:
+		return "serving"
+	case StateDraining:
+		return "draining"
+	case StateKilling:
+		return "killing"
+	case StateStopped:
+		return "stopped"
+	case StatePaused:
+		return "paused"
+	}
+	return "unknown"
+}
+
+// running reports whether a Server in state s has yet to stop.
+func (s State) running() bool {
+	switch s {
+	case StateServing, StatePaused, StateDraining, StateKilling:
+		return true
+	}
+	return false
+}
+
+// Transition describes a change of the state of a Server.
+type Transition struct {
+	From State
+	To   State
+}
+
+// State returns the current state of the server. It is safe to call
+// concurrently with Serve and Stop.
+func (srv *Server) State() State {
+	return State(atomic.LoadInt32(&srv.state))
+}
+
+// Subscribe registers fn to be called on every state transition of the
+// server, in the order the transitions happen. fn must not block, and must
+// not call Stop or Serve. The returned function unregisters fn.
+func (srv *Server) Subscribe(fn func(Transition)) (unsubscribe func()) {
+	srv.stateLock.Lock()
+	defer srv.stateLock.Unlock()
+
+	if srv.subscribers == nil {
+		srv.subscribers = map[int]func(Transition){}
+	}
+	id := srv.nextSubscriber
+	srv.nextSubscriber++
+	srv.subscribers[id] = fn
+
+	return func() {
+		srv.stateLock.Lock()
+		defer srv.stateLock.Unlock()
+
+		delete(srv.subscribers, id)
+	}
+}
+
+// transition moves the server to the state to if it is currently in one of
+// the states from, and notifies subscribers. It reports whether the
+// transition happened.
+func (srv *Server) transition(to State, from ...State) bool {
+	srv.stateLock.Lock()
+	defer srv.stateLock.Unlock()
+
+	current := srv.State()
+	allowed := len(from) == 0
+	for _, s := range from {
+		if s == current {
+			allowed = true
+			break
+		}
+	}
+	if !allowed || current == to {
+		return false
+	}
+
+	atomic.StoreInt32(&srv.state, int32(to))
+	for _, fn := range srv.subscribers {
+		fn(Transition{From: current, To: to})
+	}
+	return true
+}
+
+// start moves the server to the serving state, resetting whatever a previous
+// run left behind.
+func (srv *Server) start() error {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	switch state := srv.State(); {
+	case state.running():
+		return ErrServerRunning
+	case state == StateStopped:
+		srv.discardInterrupts()
+		srv.stopChan = nil
+		srv.readyChan = nil
+		srv.stopTimeout = nil
+		if srv.keepAlivesDisabled {
+			srv.backend().setDraining(false)
+			srv.keepAlivesDisabled = false
+		}
+	}
+	if srv.startErr != nil {
+		// forget the previous attempt to start, which failed.
+		srv.startErr = nil
+		srv.failedChan = nil
+		srv.stopChan = nil
+	}
+	if srv.stopChan == nil {
+		srv.stopChan = make(chan struct{})
+	}
+	if srv.readyChan == nil {
+		srv.readyChan = make(chan struct{})
+	}
+
+	srv.transition(StateServing)
+	return nil
+}
+
+// drain moves the server to the draining state once its listener is closed.
+func (srv *Server) drain() {
+	srv.chanLock.Lock()
+	srv.keepAlivesDisabled = true
+	srv.chanLock.Unlock()
+
+	srv.transition(StateDraining, StateServing, StatePaused)
+}
+
+// finish moves the server to the stopped state, publishes the report of the
+// run and wakes up any goroutines blocked on the stop channel.
+func (srv *Server) finish(r *run) {
+	srv.chanLock.Lock()
+	defer srv.chanLock.Unlock()
+
+	srv.report = r.report
+	srv.discardInterrupts()
+	srv.transition(StateStopped)
+	srv.emit(Event{Kind: EventStopped, Count: r.report.Connections})
+	if srv.stopChan != nil {
+		close(srv.stopChan)
+	}
+}
+
+// discardInterrupts drops signals which arrived too late to be handled, so
+// they do not stop the next run. chanLock must be held.
+func (srv *Server) discardInterrupts() {
+	for {
+		select {
+		case <-srv.interrupt:
+		default:
+			return
+		}
+	}
+}
+
+// timeout returns the duration to wait before killing connections: the one
+// given to Stop, or else the ShutdownPolicy's KillAfter or the Timeout.
+// stopLock must be held.
+func (srv *Server) timeout() time.Duration {
+	if srv.stopTimeout != nil {
+		return *srv.stopTimeout
+	}
+	if p := srv.ShutdownPolicy; p != nil && p.KillAfter > 0 {
+		return p.KillAfter
+	}
+	return srv.Timeout
+}
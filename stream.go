@@ -0,0 +1,133 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+// StreamServer serves a protocol other than HTTP over a stream listener,
+// such as TCP, with the same signal handling, listener limits, keep-alive
+// setup and shutdown timeout as Server.
+//
+// Each connection is considered active for as long as its handler runs.
+// When the server starts draining, the contexts passed to the handlers are
+// cancelled so they can wind the connection down; connections still open
+// when Timeout elapses are closed.
+//
+// Example:
+//
+//	srv := &graceful.StreamServer{
+//		Addr:      ":6379",
+//		Lifecycle: graceful.Lifecycle{Timeout: 5 * time.Second},
+//		Handler: func(ctx context.Context, conn net.Conn) {
+//			// serve conn until ctx is done
+//		},
+//	}
+//	srv.ListenAndServe()
+type StreamServer struct {
+	// Addr is the TCP address to listen on by ListenAndServe.
+	Addr string
+
+	// Handler serves a connection. The connection is closed when it
+	// returns. ctx is cancelled when the server starts draining.
+	Handler func(ctx context.Context, conn net.Conn)
+
+	// Limit the number of open connections
+	ListenLimit int
+
+	// TCPKeepAlive sets the TCP keep-alive timeouts on accepted
+	// connections.
+	TCPKeepAlive time.Duration
+
+	Lifecycle
+}
+
+func (s *StreamServer) handle(ctx context.Context, conn net.Conn) {
+	s.Handler(ctx, conn)
+}
+
+// ListenAndServe listens on Addr and serves connections with graceful
+// shutdown enabled.
+func (s *StreamServer) ListenAndServe() error {
+	srv := s.server()
+	srv.TCPKeepAlive = s.TCPKeepAlive
+	l, err := srv.newTCPListener(s.Addr)
+	if err != nil {
+		return srv.startFailed(err)
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on listener and serves them with graceful
+// shutdown enabled.
+func (s *StreamServer) Serve(listener net.Listener) error {
+	srv, err := s.configure(func(srv *Server) engine {
+		return &streamEngine{srv: srv, handler: s.handle}
+	})
+	if err != nil {
+		return err
+	}
+	srv.ListenLimit = s.ListenLimit
+	srv.TCPKeepAlive = s.TCPKeepAlive
+	return srv.Serve(listener)
+}
+
+// streamEngine runs a handler on each accepted connection, reporting the
+// connection as active for the handler's whole lifetime.
+type streamEngine struct {
+	srv     *Server
+	handler func(ctx context.Context, conn net.Conn)
+
+	// ctx is passed to the handlers of the current run, and cancelled when
+	// the server starts draining.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (e *streamEngine) hook() {
+	e.ctx, e.cancel = context.WithCancel(e.srv.run.Load().(*run).ctx)
+}
+
+func (e *streamEngine) setDraining(draining bool) {
+	if draining {
+		e.cancel()
+	}
+}
+
+func (e *streamEngine) serve(l net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				// Back off like http.Server does.
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				e.srv.log(LevelError, "accept failed, retrying", "retry_in", delay, "error", err)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+
+		// Register the connection before accepting the next one, so that it
+		// is waited for if the listener is closed right away. It is never
+		// idle, as its handler runs for its whole lifetime.
+		e.srv.connState(conn, http.StateNew)
+		e.srv.connState(conn, http.StateActive)
+		go e.handle(e.ctx, conn)
+	}
+}
+
+func (e *streamEngine) handle(ctx context.Context, conn net.Conn) {
+	defer e.srv.connState(conn, http.StateClosed)
+	defer conn.Close()
+
+	e.handler(ctx, conn)
+}
@@ -0,0 +1,169 @@
+package graceful
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+// echo serves lines back to the client until ctx is done, then says goodbye.
+func echo(ctx context.Context, conn net.Conn) {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			fmt.Fprintln(conn, line)
+		case <-ctx.Done():
+			fmt.Fprintln(conn, "bye")
+			return
+		}
+	}
+}
+
+func TestStreamServerDrain(t *testing.T) {
+	l := NewPipeListener()
+	srv := &StreamServer{
+		Handler:   echo,
+		Lifecycle: Lifecycle{Timeout: killTime, NoSignalHandling: true},
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	fmt.Fprintln(conn, "hello")
+	if line, err := r.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("expected echo of hello, got %q (%v)", line, err)
+	}
+
+	srv.Stop(killTime)
+	if line, err := r.ReadString('\n'); err != nil || line != "bye\n" {
+		t.Fatalf("expected goodbye on drain, got %q (%v)", line, err)
+	}
+
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to drain")
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("Serve returned %s", err)
+	}
+	if report := srv.ShutdownReport(); report.Killed != 0 {
+		t.Fatalf("unexpected shutdown report %+v", report)
+	}
+}
+
+func TestStreamServerTimesOut(t *testing.T) {
+	l := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	srv := &StreamServer{
+		ListenLimit: 1,
+		Lifecycle:   Lifecycle{Timeout: time.Minute, Clock: clock, NoSignalHandling: true},
+		Handler: func(ctx context.Context, conn net.Conn) {
+			// Ignore ctx and wait for the client.
+			conn.Read(make([]byte, 1))
+		},
+	}
+	go srv.Serve(l)
+
+	conn, err := l.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(waitTime)
+
+	srv.Stop(time.Minute)
+	clock.BlockUntil(1)
+	select {
+	case <-srv.StopChan():
+		t.Fatal("server stopped before its timeout")
+	default:
+	}
+	clock.Advance(time.Minute)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to be killed")
+	}
+	if report := srv.ShutdownReport(); report.Killed != 1 {
+		t.Fatalf("expected 1 killed connection, got %d", report.Killed)
+	}
+	if state := srv.State(); state != StateStopped {
+		t.Fatalf("expected the server to be stopped, got %s", state)
+	}
+}
+
+func TestStreamServerLifecycle(t *testing.T) {
+	l := NewPipeListener()
+	clock := fakeclock.New(time.Now())
+	listened := make(chan []net.Addr, 1)
+	srv := &StreamServer{
+		Handler: echo,
+		Lifecycle: Lifecycle{
+			Clock:            clock,
+			ShutdownDelay:    time.Minute,
+			OnListen:         func(addrs []net.Addr) { listened <- addrs },
+			NoSignalHandling: true,
+		},
+	}
+	events, unsubscribe := srv.Events(16)
+	defer unsubscribe()
+	go srv.Serve(l)
+
+	select {
+	case addrs := <-listened:
+		if len(addrs) != 1 || addrs[0] != l.Addr() {
+			t.Fatalf("expected OnListen to be called with %v, got %v", l.Addr(), addrs)
+		}
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for OnListen")
+	}
+
+	srv.Drain()
+	clock.BlockUntil(1)
+	if state := srv.State(); state != StateServing {
+		t.Fatalf("expected the server to serve during its delay, got %s", state)
+	}
+	clock.Advance(time.Minute)
+	select {
+	case <-srv.StopChan():
+	case <-time.After(timeoutTime):
+		t.Fatal("Timed out while waiting for the server to stop")
+	}
+	if report := srv.ShutdownReport(); report.Delay != time.Minute {
+		t.Fatalf("expected a delay of %s, got %s", time.Minute, report.Delay)
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.Kind == EventStopped {
+				return
+			}
+		default:
+			t.Fatal("expected the server to emit EventStopped")
+		}
+	}
+}
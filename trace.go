@@ -0,0 +1,246 @@
+package graceful
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tracer starts the spans recorded by a Server. Its shape follows the
+// OpenTelemetry trace API, so that an adapter only has to convert
+// attributes.
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is a traced operation started by a Tracer.
+type Span interface {
+	// AddEvent records an event which happened during the span.
+	AddEvent(name string, attrs ...Attribute)
+
+	// SetAttributes annotates the span.
+	SetAttributes(attrs ...Attribute)
+
+	// End completes the span.
+	End()
+}
+
+// Attribute is a key/value pair annotating a span or a span event.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attr returns an Attribute.
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Span names and attributes recorded by a Server.
+const (
+	// ConnSpan covers the lifetime of a connection. Its events are the
+	// connection state changes, "recycled" once it crosses a limit, "first
+	// request timeout" once it is cut by FirstRequestTimeout, as well as
+	// "idle closed" and "killed" when graceful closes it.
+	ConnSpan = "graceful.conn"
+
+	// ShutdownSpan covers a shutdown, from the moment it is initiated until
+	// the server stops. Its events are the shutdown stages reached.
+	ShutdownSpan = "graceful.shutdown"
+)
+
+type noopSpan struct{}
+
+func (noopSpan) AddEvent(name string, attrs ...Attribute) {}
+func (noopSpan) SetAttributes(attrs ...Attribute)         {}
+func (noopSpan) End()                                     {}
+
+// traceConn records a connection state change on the span of conn.
+func (srv *Server) traceConn(r *run, conn net.Conn, state http.ConnState) {
+	if srv.Tracer == nil {
+		return
+	}
+	switch state {
+	case http.StateNew:
+		_, span := srv.Tracer.Start(context.Background(), ConnSpan,
+			Attr("network.local.address", conn.LocalAddr().String()),
+			Attr("network.peer.address", conn.RemoteAddr().String()),
+		)
+		span.AddEvent(state.String())
+		r.spans.Store(conn, span)
+	case http.StateClosed, http.StateHijacked:
+		if span, ok := r.spans.LoadAndDelete(conn); ok {
+			span.(Span).AddEvent(state.String())
+			span.(Span).End()
+		}
+	default:
+		if span, ok := r.spans.Load(conn); ok {
+			span.(Span).AddEvent(state.String())
+		}
+	}
+}
+
+// traceEvent records an event on the span of conn.
+func (srv *Server) traceEvent(r *run, conn net.Conn, name string) {
+	if span, ok := r.spans.Load(conn); ok {
+		span.(Span).AddEvent(name)
+	}
+}
+
+// traceClosed records that graceful closed conn. Killed connections are
+// no longer tracked, so their span ends right away.
+func (srv *Server) traceClosed(r *run, conn net.Conn, killed bool) {
+	if !killed {
+		srv.traceEvent(r, conn, "idle closed")
+		return
+	}
+	if span, ok := r.spans.LoadAndDelete(conn); ok {
+		span.(Span).AddEvent("killed")
+		span.(Span).SetAttributes(Attr("graceful.killed", true))
+		span.(Span).End()
+	}
+}
+
+// shutdownSpan returns the span of the shutdown of r, starting it the first
+// time it is called.
+func (srv *Server) shutdownSpan(r *run) Span {
+	r.shutdownSpanOnce.Do(func() {
+		r.shutdownSpan = noopSpan{}
+		if srv.Tracer != nil {
+			_, r.shutdownSpan = srv.Tracer.Start(context.Background(), ShutdownSpan)
+		}
+	})
+	return r.shutdownSpan
+}
+
+// endShutdownSpan annotates the span of the shutdown of r with its report,
+// once the connection manager has returned.
+func (srv *Server) endShutdownSpan(r *run) {
+	span := srv.shutdownSpan(r)
+	span.SetAttributes(
+		Attr("graceful.connections", r.report.Connections),
+		Attr("graceful.idle_closed", r.report.IdleClosed),
+		Attr("graceful.killed", r.report.Killed),
+		Attr("graceful.delay", r.report.Delay),
+	)
+	span.End()
+}
+
+// MemoryTracer is a Tracer recording spans in memory, such as to check them
+// in tests.
+type MemoryTracer struct {
+	// Clock is the source of time for the recorded spans. If nil, the
+	// system clock is used.
+	Clock Clock
+
+	mu    sync.Mutex
+	spans []*RecordedSpan
+}
+
+// RecordedSpan is a span recorded by a MemoryTracer.
+type RecordedSpan struct {
+	Name       string
+	Attributes []Attribute
+	Events     []SpanEvent
+	Start      time.Time
+
+	// End is the zero time until the span has ended.
+	End time.Time
+}
+
+// SpanEvent is an event recorded on a span.
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes []Attribute
+}
+
+// Attribute returns the last value set for key on the span, and reports
+// whether it was set.
+func (s RecordedSpan) Attribute(key string) (value interface{}, ok bool) {
+	for _, attr := range s.Attributes {
+		if attr.Key == key {
+			value, ok = attr.Value, true
+		}
+	}
+	return value, ok
+}
+
+// EventNames returns the names of the events of the span, in order.
+func (s RecordedSpan) EventNames() []string {
+	names := make([]string, len(s.Events))
+	for i, e := range s.Events {
+		names[i] = e.Name
+	}
+	return names
+}
+
+// Start implements Tracer.
+func (m *MemoryTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := &RecordedSpan{Name: name, Attributes: attrs, Start: m.now()}
+	m.spans = append(m.spans, s)
+	return ctx, memorySpan{m, s}
+}
+
+// Spans returns a copy of the recorded spans, in the order they were
+// started.
+func (m *MemoryTracer) Spans() []RecordedSpan {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	spans := make([]RecordedSpan, len(m.spans))
+	for i, s := range m.spans {
+		spans[i] = *s
+		spans[i].Attributes = append([]Attribute(nil), s.Attributes...)
+		spans[i].Events = append([]SpanEvent(nil), s.Events...)
+	}
+	return spans
+}
+
+// Reset discards the recorded spans.
+func (m *MemoryTracer) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.spans = nil
+}
+
+func (m *MemoryTracer) now() time.Time {
+	if m.Clock == nil {
+		return time.Now()
+	}
+	return m.Clock.Now()
+}
+
+type memorySpan struct {
+	m *MemoryTracer
+	s *RecordedSpan
+}
+
+func (s memorySpan) AddEvent(name string, attrs ...Attribute) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	s.s.Events = append(s.s.Events, SpanEvent{Name: name, Time: s.m.now(), Attributes: attrs})
+}
+
+func (s memorySpan) SetAttributes(attrs ...Attribute) {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	s.s.Attributes = append(s.s.Attributes, attrs...)
+}
+
+func (s memorySpan) End() {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+
+	if s.s.End.IsZero() {
+		s.s.End = s.m.now()
+	}
+}
@@ -0,0 +1,94 @@
+package graceful
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"gopkg.in/tylerb/graceful.v1/internal/fakeclock"
+)
+
+func TestTracer(t *testing.T) {
+	pl := NewPipeListener()
+	tracer := &MemoryTracer{}
+	clock := fakeclock.New(time.Now())
+	srv := &Server{
+		Timeout:          time.Minute,
+		Clock:            clock,
+		NoSignalHandling: true,
+		Tracer:           tracer,
+		Server: &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})},
+	}
+	go srv.Serve(pl)
+	<-srv.Ready()
+
+	// One connection stays idle, and a request holds the other one active
+	// until it is killed.
+	idle, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(waitTime)
+	active, err := pl.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	go active.Write([]byte("GET / HTTP/1.1\r\nHost: pipe\r\n\r\n"))
+	time.Sleep(waitTime)
+
+	srv.Stop(time.Minute)
+	// the idle connection is closed right away, and only the active one is
+	// left to kill.
+	awaitOpen(t, srv, 1)
+	clock.BlockUntil(1)
+	clock.Advance(time.Minute)
+	<-srv.StopChan()
+
+	var conns []RecordedSpan
+	var shutdown *RecordedSpan
+	for _, span := range tracer.Spans() {
+		if span.End.IsZero() {
+			t.Errorf("expected %s span to have ended, got events %v", span.Name, span.EventNames())
+		}
+		switch span.Name {
+		case ConnSpan:
+			conns = append(conns, span)
+		case ShutdownSpan:
+			span := span
+			shutdown = &span
+		}
+	}
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 connection spans, got %d", len(conns))
+	}
+	if events := fmt.Sprint(conns[0].EventNames()); events != "[new idle closed closed]" {
+		t.Errorf("unexpected events for the idle connection %s", events)
+	}
+	if events := fmt.Sprint(conns[1].EventNames()); events != "[new active killed]" {
+		t.Errorf("unexpected events for the active connection %s", events)
+	}
+	if killed, _ := conns[1].Attribute("graceful.killed"); killed != true {
+		t.Errorf("expected the active connection to be marked as killed, got %v", killed)
+	}
+
+	if shutdown == nil {
+		t.Fatal("expected a shutdown span")
+	}
+	if events := fmt.Sprint(shutdown.EventNames()); events != "[stage stage]" {
+		t.Errorf("unexpected events for the shutdown %s", events)
+	}
+	for key, want := range map[string]interface{}{
+		"graceful.connections": 2,
+		"graceful.idle_closed": 1,
+		"graceful.killed":      1,
+	} {
+		if got, _ := shutdown.Attribute(key); got != want {
+			t.Errorf("expected %s to be %v, got %v", key, want, got)
+		}
+	}
+}